@@ -0,0 +1,210 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+// lookup asks for the contract of an artist for a song in a genre; the genre
+// only matters to artists without a contract, who may be paid by genre.
+type lookup struct {
+	Artist string `json:"artist"`
+	Genre  string `json:"genre"`
+}
+
+// cacheEntry is a contract and when it stops being fresh.
+type cacheEntry struct {
+	key      string
+	contract contract
+	expires  time.Time
+}
+
+// cacheCall is a fetch in progress that other callers for the same lookup
+// wait on instead of making their own.
+type cacheCall struct {
+	done     chan struct{}
+	contract contract
+	err      error
+}
+
+// fetchFunc fetches the contracts for lookups from the contracts service.
+type fetchFunc func(ctx context.Context, lookups []lookup) (map[lookup]contract, error)
+
+// contractCache keeps recently used contracts keyed by normalized artist and
+// genre. Default contracts, and the lack of one, are kept for a shorter time
+// than real ones. Once an entry
+// expires it is still returned, for up to maxStale, while it is refreshed in
+// the background so that a contracts outage doesn't reach the caller.
+type contractCache struct {
+	mutex       sync.Mutex
+	ttl         time.Duration
+	negativeTtl time.Duration
+	maxStale    time.Duration
+	maxEntries  int
+	entries     map[string]*list.Element
+	order       *list.List
+	calls       map[string]*cacheCall
+}
+
+func newContractCache(maxEntries int, ttl, negativeTtl, maxStale time.Duration) *contractCache {
+	return &contractCache{
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		maxStale:    maxStale,
+		maxEntries:  maxEntries,
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+		calls:       map[string]*cacheCall{},
+	}
+}
+
+// cacheKey makes lookups that differ only by case or spacing share an entry.
+func cacheKey(l lookup) string {
+	normalize := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+	return normalize(l.Artist) + "\x1f" + normalize(l.Genre)
+}
+
+// getMany returns the contracts for the lookups, keyed by lookup as given,
+// from the cache or with one call to fetch for all those that are missing.
+// Lookups that could not be fetched are left out and the error is returned.
+func (c *contractCache) getMany(ctx context.Context, lookups []lookup, fetch fetchFunc) (map[lookup]contract, error) {
+	if c.maxEntries <= 0 {
+		return fetch(ctx, lookups)
+	}
+	found := map[lookup]contract{}
+	waiting := map[lookup]*cacheCall{}
+	missing := []lookup{}
+	now := time.Now()
+
+	c.mutex.Lock()
+	for _, l := range lookups {
+		if _, ok := found[l]; ok {
+			continue
+		}
+		if _, ok := waiting[l]; ok {
+			continue
+		}
+		key := cacheKey(l)
+		if element, ok := c.entries[key]; ok {
+			entry := element.Value.(*cacheEntry)
+			if now.Before(entry.expires) {
+				c.order.MoveToFront(element)
+				contractCacheLookups.WithLabelValues("hit").Inc()
+				found[l] = entry.contract
+				continue
+			}
+			if now.Before(entry.expires.Add(c.maxStale)) {
+				c.order.MoveToFront(element)
+				contractCacheLookups.WithLabelValues("stale").Inc()
+				found[l] = entry.contract
+				if _, refreshing := c.calls[key]; !refreshing {
+					c.calls[key] = &cacheCall{done: make(chan struct{})}
+					go c.fill(context.Background(), []lookup{l}, fetch)
+				}
+				continue
+			}
+		}
+
+		// wait for a fetch already in progress or add it to this one
+		contractCacheLookups.WithLabelValues("miss").Inc()
+		call, ok := c.calls[key]
+		if !ok {
+			call = &cacheCall{done: make(chan struct{})}
+			c.calls[key] = call
+			missing = append(missing, l)
+		}
+		waiting[l] = call
+	}
+	c.mutex.Unlock()
+
+	if len(missing) > 0 {
+		c.fill(ctx, missing, fetch)
+	}
+	var err error
+	for l, call := range waiting {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			// as if its own fetch had timed out, so that the song is degraded
+			return found, &statusError{http.StatusGatewayTimeout, "the contracts service did not respond in time."}
+		}
+		if call.err != nil {
+			err = call.err
+			continue
+		}
+		found[l] = call.contract
+	}
+	return found, err
+}
+
+// last returns the most recent contract for the lookup however old it is.
+func (c *contractCache) last(l lookup) (contract, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[cacheKey(l)]
+	if !ok {
+		return contract{}, false
+	}
+	return element.Value.(*cacheEntry).contract, true
+}
+
+// fill fetches the contracts for lookups whose calls have been registered,
+// stores them and wakes anyone waiting on them.
+func (c *contractCache) fill(ctx context.Context, lookups []lookup, fetch fetchFunc) {
+	fetched, err := fetch(ctx, lookups)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, l := range lookups {
+		key := cacheKey(l)
+		call := c.calls[key]
+		delete(c.calls, key)
+		val, ok := fetched[l]
+		if err == nil && !ok {
+			// a bad answer from the contracts service is degraded like it
+			// being unavailable
+			call.err = &statusError{http.StatusBadGateway, fmt.Sprintf("no contract was returned for %v.", l.Artist)}
+		} else {
+			call.err = err
+		}
+		if call.err == nil {
+			call.contract = val
+			c.put(key, val)
+		} else {
+			contractCacheErrors.Inc()
+			platform.LoggerFor(ctx).Errorf("the contract for %v could not be fetched - %v", l.Artist, call.err)
+		}
+		close(call.done)
+	}
+}
+
+// put stores the contract, evicting the least recently used entries to stay
+// within the size bound. The caller must hold the mutex.
+func (c *contractCache) put(key string, val contract) {
+	ttl := c.ttl
+	if val.Default || val.Source == sourceNone {
+		ttl = c.negativeTtl
+	}
+	entry := &cacheEntry{key: key, contract: val, expires: time.Now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		contractCacheEvictions.Inc()
+	}
+	contractCacheEntries.Set(float64(c.order.Len()))
+}
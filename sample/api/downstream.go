@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// upstream is a service the gateway calls. Every call has a timeout, GETs
+// are retried with jittered backoff, and a circuit breaker stops calls to a
+// service that keeps failing.
+type upstream struct {
+	name    string
+	baseUrl string
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	breaker *circuitBreaker
+}
+
+// newUpstream configures an upstream from environment variables that start
+// with prefix: for example SONGS_BASE_URL, SONGS_TIMEOUT_MS, SONGS_RETRIES,
+// SONGS_RETRY_BACKOFF_MS, SONGS_BREAKER_FAILURES and SONGS_BREAKER_COOLDOWN_MS.
+// Every duration is in milliseconds.
+func newUpstream(name, prefix, baseUrl string, timeout time.Duration) *upstream {
+	if url, ok := os.LookupEnv(prefix + "_BASE_URL"); ok {
+		baseUrl = url
+	}
+	u := &upstream{
+		name:    name,
+		baseUrl: baseUrl,
+		client: &http.Client{
+			Timeout:   time.Duration(envOrInt(prefix+"_TIMEOUT_MS", int(timeout/time.Millisecond))) * time.Millisecond,
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		},
+		retries: envOrInt(prefix+"_RETRIES", 2),
+		backoff: time.Duration(envOrInt(prefix+"_RETRY_BACKOFF_MS", 100)) * time.Millisecond,
+		breaker: &circuitBreaker{
+			name:      name,
+			threshold: envOrInt(prefix+"_BREAKER_FAILURES", 5),
+			cooldown:  time.Duration(envOrInt(prefix+"_BREAKER_COOLDOWN_MS", 30000)) * time.Millisecond,
+		},
+	}
+	platform.ServiceLog.Infof("calling %v service at %v with a %v timeout and %v retries...", name, u.baseUrl, u.client.Timeout, u.retries)
+	return u
+}
+
+// retryable reports whether a response is worth trying again.
+func retryable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// outcome describes the result of a call for the metrics.
+func outcome(resp *http.Response, err error) string {
+	var timeout interface{ Timeout() bool }
+	switch {
+	case err == nil:
+		return strconv.Itoa(resp.StatusCode)
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// do sends the request. Only GET and HEAD are retried since anything else
+// might not be safe to repeat. Failures are returned as a statusError.
+func (u *upstream) do(req *http.Request) (*http.Response, error) {
+	return u.send(req, req.Method == "GET" || req.Method == "HEAD")
+}
+
+// doIdempotent sends a request that is safe to repeat whatever its method,
+// such as a POST that only reads, and retries it like a GET. The body is
+// sent again from GetBody, which requests made from a bytes.Reader have.
+func (u *upstream) doIdempotent(req *http.Request) (*http.Response, error) {
+	return u.send(req, req.Body == nil || req.GetBody != nil)
+}
+
+// bodyFailed reports whether the request body could not be read, such as
+// when it was larger than the gateway accepts.
+func bodyFailed(req *http.Request) bool {
+	body, ok := req.Body.(interface{ readErr() error })
+	return ok && body.readErr() != nil
+}
+
+func (u *upstream) send(req *http.Request, retry bool) (*http.Response, error) {
+	attempts := 1
+	if retry {
+		attempts += u.retries
+	}
+	for attempt := 0; ; attempt++ {
+		if req.Context().Err() != nil {
+			return nil, &statusError{http.StatusGatewayTimeout, fmt.Sprint("the ", u.name, " service did not respond in time.")}
+		}
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, &statusError{http.StatusInternalServerError, fmt.Sprint("failed to contact ", u.name, " service.")}
+			}
+			req.Body = body
+		}
+		platform.SetTimeoutHeader(req)
+		platform.SetRequestIdHeader(req)
+		if !u.breaker.allow() {
+			platform.LoggerFor(req.Context()).Warnf("the circuit to the %v service is open.", u.name)
+			observeUpstream(req, u.name, "circuit_open", time.Now())
+			return nil, &statusError{http.StatusServiceUnavailable, fmt.Sprint("the ", u.name, " service is unavailable.")}
+		}
+		start := time.Now()
+		resp, err := u.client.Do(req)
+		observeUpstream(req, u.name, outcome(resp, err), start)
+		if req.Context().Err() != nil || bodyFailed(req) {
+			// the caller ran out of time or sent a body that could not be
+			// read, which says nothing about the service
+			u.breaker.abandon()
+		} else {
+			u.breaker.record(err == nil && resp.StatusCode < 500)
+		}
+		if attempt+1 >= attempts || (err == nil && !retryable(resp.StatusCode)) {
+			if err != nil {
+				platform.LoggerFor(req.Context()).Errorf("failed to contact %v service - %v", u.name, err)
+				var timeout interface{ Timeout() bool }
+				if errors.As(err, &timeout) && timeout.Timeout() {
+					return nil, &statusError{http.StatusGatewayTimeout, fmt.Sprint("the ", u.name, " service did not respond in time.")}
+				}
+				return nil, &statusError{http.StatusInternalServerError, fmt.Sprint("failed to contact ", u.name, " service.")}
+			}
+			return resp, nil
+		}
+
+		// wait between half and all of an exponentially growing backoff
+		if err != nil {
+			platform.LoggerFor(req.Context()).Warnf("retrying %v service after error - %v", u.name, err)
+		} else {
+			platform.LoggerFor(req.Context()).Warnf("retrying %v service after status %v.", u.name, resp.StatusCode)
+			resp.Body.Close()
+		}
+		delay := u.backoff << attempt
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, &statusError{http.StatusGatewayTimeout, fmt.Sprint("the ", u.name, " service did not respond in time.")}
+		}
+	}
+}
+
+// circuitBreaker opens after threshold consecutive failures. Once the
+// cooldown has passed a single probe is let through; its result decides
+// whether the circuit closes again or stays open for another cooldown.
+type circuitBreaker struct {
+	name      string
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+// allow reports whether a call may be made now.
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// abandon gives up a call that allow let through without counting it.
+func (b *circuitBreaker) abandon() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+// record counts the result of a call that allow let through.
+func (b *circuitBreaker) record(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	wasOpen := b.threshold > 0 && b.failures >= b.threshold
+	b.probing = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if !wasOpen {
+			platform.ServiceLog.Warnf("opening the circuit to the %v service after %v consecutive failures.", b.name, b.failures)
+		}
+		b.openedAt = time.Now()
+	}
+}
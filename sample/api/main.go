@@ -1,61 +1,292 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/plasne/aks-lab/sample/platform"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// contract is what an artist is paid; source says whether it is the artist's
+// own contract or a default, or that under a strict policy there is none.
 type contract struct {
 	Artist  string  `json:"artist"`
 	Payment float64 `json:"payment"`
+	Default bool    `json:"default,omitempty"`
+	Source  string  `json:"source,omitempty"`
+	Tiers   []tier  `json:"tiers,omitempty"`
+	Splits  []split `json:"splits,omitempty"`
 }
 
-var songsBaseUrl string = "http://songs"
-var contractsBaseUrl string = "http://contracts"
+// tier is the payment per play from a number of plays until the next tier.
+type tier struct {
+	From    int64   `json:"from"`
+	Payment float64 `json:"payment"`
+}
+
+// split is the share of the payout that goes to one party of a collaboration.
+type split struct {
+	Party string  `json:"party"`
+	Share float64 `json:"share"`
+}
+
+// payment is how a song's payment is returned from richPaymentVersion on,
+// with the terms of the contract instead of only its rate.
+type payment struct {
+	Rate    float64 `json:"rate"`
+	Default bool    `json:"default"`
+	Source  string  `json:"source"`
+	Tiers   []tier  `json:"tiers,omitempty"`
+	Splits  []split `json:"splits,omitempty"`
+}
+
+// the source of the contract for an artist that has none.
+const sourceNone = "none"
+
+// richPaymentVersion is the x-api-version that returns payments as a
+// payment rather than a rate. It has the songs of v2, which is what is asked
+// of the song service.
+const richPaymentVersion = "v3"
+
+// songsVersion is the x-api-version to ask the song service for.
+func songsVersion(apiVersion string) string {
+	if apiVersion == richPaymentVersion {
+		return "v2"
+	}
+	return apiVersion
+}
+
+var songsService *upstream
+var contractsService *upstream
+
+// contractsDegradation decides what happens to a song when its contract
+// can't be fetched: "fail" the request, "omit" the payment, or use the
+// "cached" contract, omitting the payment if there isn't one.
+var contractsDegradation = "cached"
+var contracts *contractCache
+
+// statusError is returned when a downstream service fails and carries the
+// status and message that should be returned to the caller.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v %v", e.status, e.message)
+}
+
+// writeError responds with the status and message of a statusError or with
+// a 500 for any other error.
+func writeError(w http.ResponseWriter, err error) {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		platform.HttpError(w, statusErr.message, statusErr.status)
+		return
+	}
+	platform.HttpError(w, err.Error(), http.StatusInternalServerError)
+}
+
+// getContracts returns the contracts for the lookups from the cache, fetching
+// any that are missing from the contracts service in one call.
+func getContracts(ctx context.Context, lookups []lookup) (map[lookup]contract, error) {
+	return contracts.getMany(ctx, lookups, fetchContracts)
+}
+
+// fetchContracts fetches the contracts for the lookups from the contracts
+// service.
+func fetchContracts(ctx context.Context, lookups []lookup) (map[lookup]contract, error) {
+	val := map[lookup]contract{}
+
+	// call "contracts" entity service; the lookups are POSTed so that each
+	// can have a genre, but only read so they can be retried
+	body, err := json.Marshal(map[string][]lookup{"lookups": lookups})
+	if err != nil {
+		platform.LoggerFor(ctx).Errorf("failed to create contract request - %v", err)
+		return val, &statusError{http.StatusInternalServerError, "failed to create contract request."}
+	}
+	contractReq, err := http.NewRequestWithContext(ctx, "POST", contractsService.baseUrl+"/batch", bytes.NewReader(body))
+	if err != nil {
+		platform.LoggerFor(ctx).Errorf("failed to create contract request - %v", err)
+		return val, &statusError{http.StatusInternalServerError, "failed to create contract request."}
+	}
+	// let the contracts service count the call under the same version
+	if version := platform.ApiVersionFrom(ctx); version != "none" && version != "other" {
+		contractReq.Header.Set("x-api-version", version)
+	}
+	contractReq.Header.Set("Content-Type", "application/json")
+	platform.LoggerFor(ctx).Debugf("fetching %v contracts from entity service...", len(lookups))
+	contractResp, err := contractsService.doIdempotent(contractReq)
+	if err != nil {
+		return val, err
+	}
+	defer contractResp.Body.Close()
+	if contractResp.StatusCode < 200 || contractResp.StatusCode > 299 {
+		body, err := io.ReadAll(contractResp.Body)
+		if err != nil {
+			platform.LoggerFor(ctx).Errorf("received error from contracts service - %v %v", contractResp.StatusCode, err)
+			return val, &statusError{http.StatusInternalServerError, "received error from contracts service."}
+		}
+		platform.LoggerFor(ctx).Errorf("received error from contracts service - %v %v", contractResp.StatusCode, string(body))
+		return val, &statusError{contractResp.StatusCode, string(body)}
+	}
+
+	// extract the payments; they are in the order they were asked for with
+	// null for artists without a contract under a strict policy
+	var found []*contract
+	err = json.NewDecoder(contractResp.Body).Decode(&found)
+	if err != nil || len(found) != len(lookups) {
+		platform.LoggerFor(ctx).Errorf("the contracts could not be read - %v", err)
+		return val, &statusError{http.StatusInternalServerError, "failed to get contracts from entity service."}
+	}
+	for i, l := range lookups {
+		if found[i] == nil {
+			val[l] = contract{Artist: l.Artist, Source: sourceNone}
+			continue
+		}
+		val[l] = *found[i]
+	}
+	platform.LoggerFor(ctx).Infof("successfully retrieved %v contracts.", len(val))
+	return val, nil
+}
+
+// songLookup is the contract lookup for the song, if it has an artist.
+func songLookup(song map[string]interface{}) (lookup, bool) {
+	artist, ok := song["artist"].(string)
+	genre, _ := song["genre"].(string)
+	return lookup{Artist: artist, Genre: genre}, ok
+}
+
+// setPayment sets the payment on the song from the contract and whether it
+// came from a default contract, or the whole payment if rich. Under a strict
+// policy an artist without a contract has a null payment.
+func setPayment(song map[string]interface{}, c contract, rich bool) {
+	switch {
+	case c.Source == sourceNone:
+		song["payment"] = nil
+	case rich:
+		song["payment"] = payment{Rate: c.Payment, Default: c.Default, Source: c.Source, Tiers: c.Tiers, Splits: c.Splits}
+	default:
+		song["payment"] = c.Payment
+		song["defaultContract"] = c.Default
+	}
+}
+
+// addPayments sets the payment on each song from its artist's contract;
+// songs without an artist are left as they are. If the contracts service is
+// unavailable the songs are degraded according to contractsDegradation and
+// the Warnings for the response are returned. Payments are rich if the caller
+// asked for richPaymentVersion.
+func addPayments(ctx context.Context, songs []map[string]interface{}, rich bool) ([]string, error) {
+	lookups := []lookup{}
+	seen := map[lookup]bool{}
+	for _, song := range songs {
+		if l, ok := songLookup(song); ok && !seen[l] {
+			seen[l] = true
+			lookups = append(lookups, l)
+		}
+	}
+	if len(lookups) == 0 {
+		return nil, nil
+	}
+	found, err := getContracts(ctx, lookups)
+	var statusErr *statusError
+	if err != nil && (contractsDegradation == "fail" || !errors.As(err, &statusErr) || statusErr.status < 500) {
+		return nil, err
+	}
+
+	// songs whose contract wasn't found are returned without a current payment
+	warnings := []string{}
+	warned := map[string]bool{}
+	for _, song := range songs {
+		l, ok := songLookup(song)
+		if !ok {
+			continue
+		}
+		if contract, ok := found[l]; ok {
+			setPayment(song, contract, rich)
+			continue
+		}
+		song["degraded"] = true
+		warning := `199 - "the payment was omitted because contracts are unavailable"`
+		if contract, ok := contracts.last(l); ok && contractsDegradation == "cached" {
+			setPayment(song, contract, rich)
+			warning = `110 - "the payment is from a cached contract"`
+			platform.LoggerFor(ctx).Warnf("using the cached contract for %v - %v", l.Artist, err)
+		} else {
+			platform.LoggerFor(ctx).Warnf("omitting the payment for %v - %v", l.Artist, err)
+		}
+		if !warned[warning] {
+			warned[warning] = true
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings, nil
+}
+
+// relayError returns an error response from a downstream service to the
+// caller unchanged so structured bodies, like problem details, survive.
+func relayError(w http.ResponseWriter, resp *http.Response, service string) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		platform.HttpError(w, fmt.Sprint("received error from ", service, " service."), http.StatusInternalServerError)
+		platform.LoggerFor(resp.Request.Context()).Errorf("received error from %v service - %v %v", service, resp.StatusCode, err)
+		return
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+	logger := platform.LoggerFor(resp.Request.Context())
+	if resp.StatusCode < 500 {
+		logger.Warnf("received error from %v service - %v %v", service, resp.StatusCode, strings.TrimSpace(string(body)))
+		return
+	}
+	logger.Errorf("received error from %v service - %v %v", service, resp.StatusCode, strings.TrimSpace(string(body)))
+}
 
 func retrieveSong(w http.ResponseWriter, r *http.Request) {
 	// determine the expected x-api-version
-	apiVersion := r.Header.Get("x-api-version")
+	apiVersion := songsVersion(r.Header.Get("x-api-version"))
 
 	// create the request
-	songUrl := fmt.Sprint(songsBaseUrl, "/?id=", r.URL.Query().Get("id"))
-	songReq, err := http.NewRequest("GET", songUrl, nil)
-	if apiVersion != "" {
-		songReq.Header.Set("x-api-version", apiVersion)
-	}
+	songUrl := fmt.Sprint(songsService.baseUrl, "/?id=", url.QueryEscape(r.URL.Query().Get("id")))
+	songReq, err := http.NewRequestWithContext(r.Context(), "GET", songUrl, nil)
 	if err != nil {
-		http.Error(w, "failed to create song request.", http.StatusInternalServerError)
-		log.Printf("failed to create song request - %v", err)
+		platform.HttpError(w, "failed to create song request.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("failed to create song request - %v", err)
 		return
 	}
+	if apiVersion != "" {
+		songReq.Header.Set("x-api-version", apiVersion)
+	}
 
 	// call "song" entity service
-	log.Printf("fetching song from entity service (%v)...\n", songUrl)
-	client := http.Client{}
-	songResp, err := client.Do(songReq)
+	platform.LoggerFor(r.Context()).Debugf("fetching song from entity service (%v)...", songUrl)
+	songResp, err := songsService.do(songReq)
 	if err != nil {
-		http.Error(w, "failed to contact song service.", http.StatusInternalServerError)
-		log.Printf("failed to contact song service - %v", err)
+		writeError(w, err)
 		return
 	}
+	defer songResp.Body.Close()
 	if songResp.StatusCode < 200 || songResp.StatusCode > 299 {
-		body, err := io.ReadAll(songResp.Body)
-		if err != nil {
-			http.Error(w, "received error from song service.", http.StatusInternalServerError)
-			log.Printf("received error from song service - %v %v", songResp.StatusCode, err)
-		} else {
-			http.Error(w, string(body), songResp.StatusCode)
-			log.Printf("received error from song service - %v %v", songResp.StatusCode, string(body))
-		}
+		relayError(w, songResp, "song")
 		return
 	}
 
@@ -63,130 +294,322 @@ func retrieveSong(w http.ResponseWriter, r *http.Request) {
 	var song map[string]interface{}
 	err = json.NewDecoder(songResp.Body).Decode(&song)
 	if err != nil {
-		http.Error(w, "failed to get song from entity service.", http.StatusInternalServerError)
-		log.Println(err)
+		platform.HttpError(w, "failed to get song from entity service.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("%v", err)
 		return
 	}
-	log.Println("successfully retrieved song.")
+	platform.LoggerFor(r.Context()).Infof("successfully retrieved song.")
 
 	// if there is an artist, get the artist's contract
-	artistAsInterface, hasArtist := song["artist"]
-	artist, artistIsString := artistAsInterface.(string)
-	if hasArtist && artistIsString {
-		// call "contracts" entity service
-		contractUrl := fmt.Sprint(contractsBaseUrl, "/?artist=", url.QueryEscape(artist))
-		log.Printf("fetching contract from entity service (%v)...\n", contractUrl)
-		contractResp, err := http.Get(contractUrl)
-		if err != nil {
-			http.Error(w, "failed to contact contracts service.", http.StatusInternalServerError)
-			log.Printf("failed to contact contracts service - %v", err)
-			return
-		}
-		if contractResp.StatusCode < 200 || contractResp.StatusCode > 299 {
-			body, err := io.ReadAll(contractResp.Body)
-			if err != nil {
-				http.Error(w, "received error from contracts service.", http.StatusInternalServerError)
-				log.Printf("received error from contracts service - %v %v", contractResp.StatusCode, err)
-			} else {
-				http.Error(w, string(body), contractResp.StatusCode)
-				log.Printf("received error from contracts service - %v %v", contractResp.StatusCode, string(body))
-			}
-			return
-		}
-
-		// extract the payment
-		var contract contract
-		err = json.NewDecoder(contractResp.Body).Decode(&contract)
-		if err != nil {
-			http.Error(w, "failed to get contract from entity service.", http.StatusInternalServerError)
-			log.Println(err)
-			return
-		}
-		log.Println("successfully retrieved contract.")
-		song["payment"] = contract.Payment
+	warnings, err := addPayments(r.Context(), []map[string]interface{}{song}, r.Header.Get("x-api-version") == richPaymentVersion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, warning := range warnings {
+		w.Header().Add("Warning", warning)
 	}
 
 	// write the output
 	bytes, err := json.Marshal(song)
 	if err != nil {
-		http.Error(w, "the song could not be marshalled.", http.StatusInternalServerError)
-		log.Println(err)
+		platform.HttpError(w, "the song could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("%v", err)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	_, err = w.Write(bytes)
 	if err != nil {
-		http.Error(w, "the song could not be returned.", http.StatusInternalServerError)
-		log.Println(err)
+		platform.HttpError(w, "the song could not be returned.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("%v", err)
 		return
 	}
 }
 
+func searchSongs(w http.ResponseWriter, r *http.Request) {
+	// determine the expected x-api-version
+	apiVersion := songsVersion(r.Header.Get("x-api-version"))
+
+	// create the request
+	searchUrl := fmt.Sprint(songsService.baseUrl, "/search?", r.URL.RawQuery)
+	searchReq, err := http.NewRequestWithContext(r.Context(), "GET", searchUrl, nil)
+	if err != nil {
+		platform.HttpError(w, "failed to create search request.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("failed to create search request - %v", err)
+		return
+	}
+	if apiVersion != "" {
+		searchReq.Header.Set("x-api-version", apiVersion)
+	}
+
+	// call "song" entity service
+	platform.LoggerFor(r.Context()).Debugf("searching songs in entity service (%v)...", searchUrl)
+	searchResp, err := songsService.do(searchReq)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer searchResp.Body.Close()
+	if searchResp.StatusCode < 200 || searchResp.StatusCode > 299 {
+		relayError(w, searchResp, "song")
+		return
+	}
+
+	// decode the results
+	var result struct {
+		Items    []map[string]interface{} `json:"items"`
+		Degraded bool                     `json:"degraded,omitempty"`
+	}
+	err = json.NewDecoder(searchResp.Body).Decode(&result)
+	if err != nil {
+		platform.HttpError(w, "failed to get songs from entity service.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("%v", err)
+		return
+	}
+	platform.LoggerFor(r.Context()).Infof("successfully found %v songs.", len(result.Items))
+
+	// get the contracts for the artists of all the songs at once
+	warnings, err := addPayments(r.Context(), result.Items, r.Header.Get("x-api-version") == richPaymentVersion)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, warning := range warnings {
+		w.Header().Add("Warning", warning)
+	}
+	result.Degraded = len(warnings) > 0
+
+	// write the output
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		platform.HttpError(w, "the songs could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("%v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.HttpError(w, "the songs could not be returned.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("%v", err)
+		return
+	}
+}
+
+// the headers from the song service that are passed back to the caller of
+// a proxied request.
+var proxiedHeaders = []string{"Content-Type", "Location", "Retry-After", "Idempotent-Replayed"}
+
+// maxBodySize is the largest request body that is forwarded.
+var maxBodySize int64 = 1 << 20
+
+// cappedBody remembers why reading the body failed so an oversized body can
+// be reported as such; the transport reads it on its own goroutine.
+type cappedBody struct {
+	io.ReadCloser
+	mutex sync.Mutex
+	err   error
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.mutex.Lock()
+		b.err = err
+		b.mutex.Unlock()
+	}
+	return n, err
+}
+
+func (b *cappedBody) readErr() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.err
+}
+
+// setForwardedHeaders tells the song service who the original client was.
+func setForwardedHeaders(req *http.Request, r *http.Request) {
+	clientIp, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIp = r.RemoteAddr
+	}
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		clientIp = prior + ", " + clientIp
+	}
+	req.Header.Set("X-Forwarded-For", clientIp)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
+
 func storeSong(w http.ResponseWriter, r *http.Request) {
 	// determine the expected x-api-version
-	apiVersion := r.Header.Get("x-api-version")
+	apiVersion := songsVersion(r.Header.Get("x-api-version"))
+
+	// refuse bodies that are too big before sending anything
+	if r.ContentLength > maxBodySize {
+		platform.HttpError(w, "the song is too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := &cappedBody{ReadCloser: http.MaxBytesReader(w, r.Body, maxBodySize)}
 
 	// create the request
-	songUrl := fmt.Sprint(songsBaseUrl, "/?id=", r.URL.Query().Get("id"))
-	songReq, err := http.NewRequest("POST", songUrl, r.Body)
+	songUrl := fmt.Sprint(songsService.baseUrl, "/")
+	songReq, err := http.NewRequestWithContext(r.Context(), "POST", songUrl, body)
+	if err != nil {
+		platform.HttpError(w, "failed to create song request.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("failed to create song request - %v", err)
+		return
+	}
+	songReq.ContentLength = r.ContentLength
 	songReq.Header.Set("Content-Type", "application/json")
 	if apiVersion != "" {
 		songReq.Header.Set("x-api-version", apiVersion)
 	}
+	setForwardedHeaders(songReq, r)
+
+	// pass the key through so the song service can recognize a retry
+	if idempotencyKey := r.Header.Get("Idempotency-Key"); idempotencyKey != "" {
+		songReq.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	// call "song" entity service
+	platform.LoggerFor(r.Context()).Debugf("federating store-song request to entity service...")
+	resp, err := songsService.do(songReq)
+	if err != nil && body.readErr() != nil {
+		platform.HttpError(w, "the song is too large.", http.StatusRequestEntityTooLarge)
+		platform.LoggerFor(r.Context()).Warnf("the song could not be read - %v", body.readErr())
+		return
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// copy the status, the allowed headers and the body as it arrives; the
+	// location is rewritten to point at the gateway
+	for _, header := range proxiedHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	if location := resp.Header.Get("Location"); strings.HasPrefix(location, "/?") {
+		w.Header().Set("Location", "/song"+location[1:])
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		platform.LoggerFor(r.Context()).Errorf("the song response could not be relayed - %v", err)
+		return
+	}
+	platform.LoggerFor(r.Context()).Infof("relayed %v from song service.", resp.StatusCode)
+}
+
+func modifySong(w http.ResponseWriter, r *http.Request) {
+	// determine the expected x-api-version
+	apiVersion := songsVersion(r.Header.Get("x-api-version"))
+
+	// create the request
+	songUrl := fmt.Sprint(songsService.baseUrl, "/?id=", url.QueryEscape(r.URL.Query().Get("id")))
+	songReq, err := http.NewRequestWithContext(r.Context(), r.Method, songUrl, r.Body)
 	if err != nil {
-		http.Error(w, "failed to create song request.", http.StatusInternalServerError)
-		log.Println(err)
+		platform.HttpError(w, "failed to create song request.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("failed to create song request - %v", err)
 		return
 	}
+	if r.Method != "DELETE" {
+		songReq.Header.Set("Content-Type", "application/json")
+	}
+	if apiVersion != "" {
+		songReq.Header.Set("x-api-version", apiVersion)
+	}
 
 	// call "song" entity service
-	log.Println("federating store-song request to entity service...")
-	client := http.Client{}
-	resp, err := client.Do(songReq)
+	platform.LoggerFor(r.Context()).Debugf("federating %v song request to entity service (%v)...", r.Method, songUrl)
+	resp, err := songsService.do(songReq)
 	if err != nil {
-		http.Error(w, "failed to contact song service.", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, "received error from contracts service.", http.StatusInternalServerError)
-			log.Printf("received error from contracts service - %v %v", resp.StatusCode, err)
-		} else {
-			http.Error(w, string(body), resp.StatusCode)
-			log.Printf("received error from contracts service - %v %v", resp.StatusCode, string(body))
-		}
+		relayError(w, resp, "song")
+		return
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
 	// write the output
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "failed to get song from song service.", http.StatusInternalServerError)
+		platform.HttpError(w, "failed to get song from song service.", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	_, err = w.Write(body)
 	if err != nil {
-		http.Error(w, "the song could not be returned.", http.StatusInternalServerError)
+		platform.HttpError(w, "the song could not be returned.", http.StatusInternalServerError)
 		return
 	}
 }
 
+// envOrInt reads an integer from the environment or returns def.
+func envOrInt(key string, def int) int {
+	val, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
 func main() {
 	// load variables
 	godotenv.Load()
+	if err := platform.SetupLogging("api"); err != nil {
+		platform.ServiceLog.Fatalf("unable to set up logging - %v", err)
+	}
+	shutdown, err := platform.SetupTracing(context.Background(), "api")
+	if err != nil {
+		platform.ServiceLog.Fatalf("unable to set up tracing - %v", err)
+	}
+	defer shutdown(context.Background())
 	port, err := strconv.Atoi(os.Getenv("PORT"))
 	if err != nil {
 		port = 80
 	}
-	if url, ok := os.LookupEnv("SONGS_BASE_URL"); ok {
-		songsBaseUrl = url
+	rand.Seed(time.Now().UnixNano())
+	songsService = newUpstream("song", "SONGS", "http://songs", 10*time.Second)
+	contractsService = newUpstream("contracts", "CONTRACTS", "http://contracts", 2*time.Second)
+	maxBodySize = int64(envOrInt("MAX_BODY_BYTES", int(maxBodySize)))
+
+	// every request must finish within this time, including downstream calls
+	requestTimeout := time.Duration(envOrInt("REQUEST_TIMEOUT_MS", 30000)) * time.Millisecond
+	platform.ServiceLog.Infof("requests must finish within %v...", requestTimeout)
+	if policy, ok := os.LookupEnv("CONTRACTS_DEGRADATION"); ok {
+		contractsDegradation = policy
 	}
-	if url, ok := os.LookupEnv("CONTRACTS_BASE_URL"); ok {
-		contractsBaseUrl = url
+	switch contractsDegradation {
+	case "fail", "omit", "cached":
+		platform.ServiceLog.Infof("when contracts are unavailable the policy is to %v...", contractsDegradation)
+	default:
+		platform.ServiceLog.Fatalf("CONTRACTS_DEGRADATION must be fail, omit or cached, not %v.", contractsDegradation)
 	}
 
+	// cache contracts; a size of 0 turns the cache off
+	cacheSize := envOrInt("CONTRACT_CACHE_SIZE", 1000)
+	cacheTtl := time.Duration(envOrInt("CONTRACT_CACHE_TTL", 300)) * time.Second
+	cacheNegativeTtl := time.Duration(envOrInt("CONTRACT_CACHE_NEGATIVE_TTL", 60)) * time.Second
+	cacheMaxStale := time.Duration(envOrInt("CONTRACT_CACHE_MAX_STALE", 3600)) * time.Second
+	contracts = newContractCache(cacheSize, cacheTtl, cacheNegativeTtl, cacheMaxStale)
+	platform.ServiceLog.Infof("caching %v contracts for %v (%v for defaults), serving stale for up to %v...", cacheSize, cacheTtl, cacheNegativeTtl, cacheMaxStale)
+
 	// setup http handlers
 	http.HandleFunc("/song", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -194,16 +617,28 @@ func main() {
 			retrieveSong(w, r)
 		case "POST":
 			storeSong(w, r)
+		case "PUT", "PATCH", "DELETE":
+			modifySong(w, r)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			searchSongs(w, r)
 		default:
-			http.Error(w, "the method is not implemented.", http.StatusNotImplemented)
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
 		}
 	})
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		// returns 200
 	})
+	http.Handle("/metrics", promhttp.Handler())
 
 	// listen
-	log.Printf("listening on port %v...\n", port)
-	err = http.ListenAndServe(fmt.Sprint(":", port), nil)
-	log.Fatal(err)
+	platform.ServiceLog.Infof("listening on port %v...", port)
+	handler := platform.WithDeadline(requestTimeout, http.DefaultServeMux)
+	err = http.ListenAndServe(fmt.Sprint(":", port), platform.Traced("api", platform.WithRequestId(platform.Measured(http.DefaultServeMux, "", handler))))
+	platform.ServiceLog.Fatalf("%v", err)
 }
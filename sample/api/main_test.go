@@ -0,0 +1,691 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	platform.LogOutput = io.Discard
+	os.Exit(m.Run())
+}
+
+// fakeContracts stands in for the contracts service, paying every artist
+// the rate it is given and counting the lookups it is asked for.
+type fakeContracts struct {
+	mutex   sync.Mutex
+	rates   map[string]float64
+	err     error
+	calls   int
+	lookups []lookup
+	fetched chan struct{}
+}
+
+func newFakeContracts(rates map[string]float64) *fakeContracts {
+	return &fakeContracts{rates: rates, fetched: make(chan struct{}, 100)}
+}
+
+func (f *fakeContracts) fetch(ctx context.Context, lookups []lookup) (map[lookup]contract, error) {
+	f.mutex.Lock()
+	defer func() {
+		f.mutex.Unlock()
+		f.fetched <- struct{}{}
+	}()
+	f.calls++
+	f.lookups = append(f.lookups, lookups...)
+	if f.err != nil {
+		return nil, f.err
+	}
+	found := map[lookup]contract{}
+	for _, l := range lookups {
+		if rate, ok := f.rates[l.Artist]; ok {
+			found[l] = contract{Artist: l.Artist, Payment: rate, Source: "contract"}
+		} else {
+			found[l] = contract{Artist: l.Artist, Payment: 0.05, Default: true, Source: "default"}
+		}
+	}
+	return found, nil
+}
+
+// asked returns how many calls were made and what they asked for.
+func (f *fakeContracts) asked() (int, []lookup) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls, append([]lookup{}, f.lookups...)
+}
+
+func TestCacheEviction(t *testing.T) {
+	fake := newFakeContracts(map[string]float64{"Drake": 0.2, "Tyga": 0.1, "Weezer": 0.3})
+	cache := newContractCache(2, time.Hour, time.Hour, 0)
+	ctx := context.Background()
+	get := func(artist string) {
+		t.Helper()
+		found, err := cache.getMany(ctx, []lookup{{Artist: artist}}, fake.fetch)
+		if err != nil || found[lookup{Artist: artist}].Artist != artist {
+			t.Fatalf("expected the contract for %v, got %+v - %v", artist, found, err)
+		}
+	}
+
+	// Tyga is the least recently used when Weezer is added
+	evictions := testutil.ToFloat64(contractCacheEvictions)
+	get("Drake")
+	get("Tyga")
+	get("Drake")
+	get("Weezer")
+	if calls, _ := fake.asked(); calls != 3 {
+		t.Fatalf("expected 3 fetches, got %v", calls)
+	}
+	if evicted := testutil.ToFloat64(contractCacheEvictions) - evictions; evicted != 1 {
+		t.Fatalf("expected 1 eviction to be counted, got %v", evicted)
+	}
+	get("Drake")
+	if calls, _ := fake.asked(); calls != 3 {
+		t.Fatalf("expected Drake to still be cached, got %v fetches", calls)
+	}
+	get("Tyga")
+	if calls, _ := fake.asked(); calls != 4 {
+		t.Fatalf("expected Tyga to have been evicted, got %v fetches", calls)
+	}
+}
+
+func TestCacheNegativeTtl(t *testing.T) {
+	fake := newFakeContracts(map[string]float64{"Drake": 0.2})
+	cache := newContractCache(10, time.Hour, -time.Second, 0)
+	ctx := context.Background()
+	lookups := []lookup{{Artist: "Drake"}, {Artist: "Nobody"}}
+	cache.getMany(ctx, lookups, fake.fetch)
+
+	// only the default contract has expired and is fetched again
+	found, err := cache.getMany(ctx, lookups, fake.fetch)
+	if err != nil || len(found) != 2 {
+		t.Fatalf("expected both contracts, got %+v - %v", found, err)
+	}
+	calls, asked := fake.asked()
+	if calls != 2 || len(asked) != 3 || asked[2].Artist != "Nobody" {
+		t.Fatalf("expected only Nobody to be fetched again, got %+v", asked)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	fake := newFakeContracts(map[string]float64{"Drake": 0.2})
+	cache := newContractCache(10, -time.Second, -time.Second, time.Hour)
+	ctx := context.Background()
+	drake := lookup{Artist: "Drake"}
+	cache.getMany(ctx, []lookup{drake}, fake.fetch)
+	<-fake.fetched
+
+	// an expired contract is returned at once while it is refreshed
+	fake.mutex.Lock()
+	fake.rates["Drake"] = 0.25
+	fake.mutex.Unlock()
+	found, err := cache.getMany(ctx, []lookup{drake}, fake.fetch)
+	if err != nil || found[drake].Payment != 0.2 {
+		t.Fatalf("expected the stale contract, got %+v - %v", found, err)
+	}
+	select {
+	case <-fake.fetched:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stale contract to be refreshed")
+	}
+	waitForRefresh(t, cache, drake)
+	if val, _ := cache.last(drake); val.Payment != 0.25 {
+		t.Fatalf("expected the refreshed contract, got %+v", val)
+	}
+
+	// a failed refresh keeps serving the stale contract
+	fake.mutex.Lock()
+	fake.err = errors.New("contracts are down")
+	fake.mutex.Unlock()
+	found, err = cache.getMany(ctx, []lookup{drake}, fake.fetch)
+	if err != nil || found[drake].Payment != 0.25 {
+		t.Fatalf("expected the stale contract while contracts are down, got %+v - %v", found, err)
+	}
+}
+
+// waitForRefresh waits until no fetch is in progress for the lookup.
+func waitForRefresh(t *testing.T, cache *contractCache, l lookup) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		cache.mutex.Lock()
+		_, refreshing := cache.calls[cacheKey(l)]
+		cache.mutex.Unlock()
+		if !refreshing {
+			return
+		}
+	}
+	t.Fatal("the refresh did not finish")
+}
+
+// testUpstream calls the server with short backoffs and cooldowns.
+func testUpstream(server *httptest.Server, retries, failures int, cooldown time.Duration) *upstream {
+	return &upstream{
+		name:    "test",
+		baseUrl: server.URL,
+		client:  server.Client(),
+		retries: retries,
+		backoff: time.Millisecond,
+		breaker: &circuitBreaker{name: "test", threshold: failures, cooldown: cooldown},
+	}
+}
+
+// call sends a request through the upstream and returns its status.
+func call(t *testing.T, u *upstream, method string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, u.baseUrl+"/", nil)
+	resp, err := u.do(req)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status
+	} else if err != nil {
+		t.Fatalf("expected a statusError, got %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	u := testUpstream(server, 2, 0, 0)
+
+	// a GET is tried again until it succeeds
+	if status := call(t, u, "GET"); status != http.StatusOK || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expected 200 after 3 calls, got %v after %v", status, atomic.LoadInt32(&calls))
+	}
+
+	// a POST might not be safe to repeat so it is tried once
+	if status := call(t, u, "POST"); status != http.StatusServiceUnavailable || atomic.LoadInt32(&calls) != 4 {
+		t.Fatalf("expected 503 after 1 call, got %v after %v", status, atomic.LoadInt32(&calls)-3)
+	}
+
+	// an error that isn't worth retrying is returned at once
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	})
+	if status := call(t, u, "GET"); status != http.StatusNotFound || atomic.LoadInt32(&calls) != 5 {
+		t.Fatalf("expected 404 after 1 call, got %v", status)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls, healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	u := testUpstream(server, 0, 2, 50*time.Millisecond)
+
+	// the circuit opens after 2 failures and stops calls reaching the service
+	call(t, u, "GET")
+	call(t, u, "GET")
+	if status := call(t, u, "GET"); status != http.StatusServiceUnavailable || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected the open circuit to answer 503, got %v after %v calls", status, atomic.LoadInt32(&calls))
+	}
+
+	// after the cooldown a failed probe keeps it open for another cooldown
+	time.Sleep(60 * time.Millisecond)
+	if status := call(t, u, "GET"); status != http.StatusInternalServerError || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("expected the probe to reach the service, got %v", status)
+	}
+	if status := call(t, u, "GET"); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected the circuit to stay open, got %v", status)
+	}
+
+	// and a successful probe closes it
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if status := call(t, u, "GET"); status != http.StatusOK {
+			t.Fatalf("expected the circuit to close, got %v", status)
+		}
+	}
+}
+
+func TestRetrieveSongEscapesId(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("id")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1,"title":"Untitled"}`))
+	}))
+	defer server.Close()
+	songsService = testUpstream(server, 0, 0, 0)
+
+	w := httptest.NewRecorder()
+	retrieveSong(w, httptest.NewRequest("GET", "/song?id="+url.QueryEscape("1&genre=Pop"), nil))
+	if w.Code != http.StatusOK || query != "1&genre=Pop" {
+		t.Fatalf("expected the id to reach the song service whole, got %v for %q", w.Code, query)
+	}
+	if !strings.Contains(w.Body.String(), "Untitled") {
+		t.Fatalf("expected the song, got %v", w.Body.String())
+	}
+}
+
+func TestStoreSong(t *testing.T) {
+	var got *http.Request
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/?id=7")
+		w.Header().Set("Set-Cookie", "session=1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":7,"title":"Untitled"}`))
+	}))
+	defer server.Close()
+	songsService = testUpstream(server, 0, 0, 0)
+
+	// the status, location and body are relayed and the client is described
+	req := httptest.NewRequest("POST", "http://gateway.example/song", strings.NewReader(`{"title":"Untitled"}`))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	req.Header.Set("Idempotency-Key", "abc")
+	w := httptest.NewRecorder()
+	storeSong(w, req)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/song?id=7" {
+		t.Fatalf("expected 201 at /song?id=7, got %v at %q", w.Code, w.Header().Get("Location"))
+	}
+	if w.Header().Get("Set-Cookie") != "" || !strings.Contains(w.Body.String(), "Untitled") {
+		t.Fatalf("expected only the allowed headers and the song, got %v %v", w.Header(), w.Body.String())
+	}
+	if body != `{"title":"Untitled"}` {
+		t.Fatalf("expected the song to be forwarded, got %q", body)
+	}
+	expected := map[string]string{
+		"X-Forwarded-For":   "198.51.100.7, 192.0.2.1",
+		"X-Forwarded-Host":  "gateway.example",
+		"X-Forwarded-Proto": "http",
+		"Idempotency-Key":   "abc",
+	}
+	for header, value := range expected {
+		if got.Header.Get(header) != value {
+			t.Fatalf("expected %v to be %q, got %q", header, value, got.Header.Get(header))
+		}
+	}
+}
+
+func TestStoreSongTooLarge(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	songsService = testUpstream(server, 0, 2, time.Hour)
+	defer func(size int64) { maxBodySize = size }(maxBodySize)
+	maxBodySize = 16
+	large := `{"title":"` + strings.Repeat("a", 64) + `"}`
+
+	// a declared length that is too large is refused without calling the service
+	w := httptest.NewRecorder()
+	storeSong(w, httptest.NewRequest("POST", "/song", strings.NewReader(large)))
+	if w.Code != http.StatusRequestEntityTooLarge || atomic.LoadInt32(&calls) != 0 {
+		t.Fatalf("expected 413 without a call, got %v after %v calls", w.Code, calls)
+	}
+
+	// a chunked body is refused once it passes the cap, and doesn't count
+	// against the service
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("POST", "/song", io.NopCloser(strings.NewReader(large)))
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+		storeSong(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected 413, got %v", w.Code)
+		}
+	}
+	if !songsService.breaker.allow() {
+		t.Fatalf("expected the circuit to stay closed after oversized songs")
+	}
+	songsService.breaker.abandon()
+	w = httptest.NewRecorder()
+	storeSong(w, httptest.NewRequest("POST", "/song", strings.NewReader(`{}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected a small song to be stored, got %v", w.Code)
+	}
+}
+
+func TestModifySong(t *testing.T) {
+	var method, id, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, id = r.Method, r.URL.Query().Get("id")
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+		switch {
+		case id == "missing":
+			http.Error(w, "the song was not found.", http.StatusNotFound)
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":1,"title":"Renamed"}`))
+		}
+	}))
+	defer server.Close()
+	songsService = testUpstream(server, 0, 0, 0)
+
+	// the method, escaped id and body are forwarded and the song relayed
+	w := httptest.NewRecorder()
+	modifySong(w, httptest.NewRequest("PATCH", "/song?id="+url.QueryEscape("1&x=2"), strings.NewReader(`{"title":"Renamed"}`)))
+	if w.Code != http.StatusOK || method != "PATCH" || id != "1&x=2" || body != `{"title":"Renamed"}` {
+		t.Fatalf("expected the patch to be forwarded, got %v %v %q %q", w.Code, method, id, body)
+	}
+	if !strings.Contains(w.Body.String(), "Renamed") {
+		t.Fatalf("expected the song, got %v", w.Body.String())
+	}
+
+	// a deletion relays 204 and a missing song relays 404
+	w = httptest.NewRecorder()
+	modifySong(w, httptest.NewRequest("DELETE", "/song?id=1", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	modifySong(w, httptest.NewRequest("PUT", "/song?id=missing", strings.NewReader(`{}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %v", w.Code)
+	}
+}
+
+// waitOnFetch leaves a fetch of Drake's contract in progress, after one that
+// was cached and has expired, until the returned func is called.
+func waitOnFetch(t *testing.T) func() {
+	t.Helper()
+	fake := newFakeContracts(map[string]float64{"Drake": 0.2})
+	contracts = newContractCache(10, -time.Second, -time.Second, 0)
+	drake := lookup{Artist: "Drake", Genre: "HipHop"}
+	contracts.getMany(context.Background(), []lookup{drake}, fake.fetch)
+
+	release := make(chan struct{})
+	go contracts.getMany(context.Background(), []lookup{drake}, func(ctx context.Context, lookups []lookup) (map[lookup]contract, error) {
+		<-release
+		return fake.fetch(ctx, lookups)
+	})
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		contracts.mutex.Lock()
+		_, fetching := contracts.calls[cacheKey(drake)]
+		contracts.mutex.Unlock()
+		if fetching {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("the fetch did not start")
+		}
+	}
+	return func() { close(release) }
+}
+
+func TestDegradationWhileWaiting(t *testing.T) {
+	defer func(policy string) { contractsDegradation = policy }(contractsDegradation)
+	tests := []struct {
+		policy  string
+		status  int
+		payment interface{}
+		warning string
+	}{
+		{"fail", http.StatusGatewayTimeout, nil, ""},
+		{"omit", 0, nil, "199"},
+		{"cached", 0, 0.2, "110"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			contractsDegradation = test.policy
+			release := waitOnFetch(t)
+			defer release()
+
+			// the request runs out of time waiting on the other one's fetch
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			song := map[string]interface{}{"artist": "Drake", "genre": "HipHop"}
+			warnings, err := addPayments(ctx, []map[string]interface{}{song}, false)
+			var statusErr *statusError
+			if test.status != 0 {
+				if !errors.As(err, &statusErr) || statusErr.status != test.status {
+					t.Fatalf("expected %v, got %v", test.status, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the song to be degraded, got %v", err)
+			}
+			if song["degraded"] != true || song["payment"] != test.payment {
+				t.Fatalf("expected a degraded song paying %v, got %+v", test.payment, song)
+			}
+			if len(warnings) != 1 || !strings.HasPrefix(warnings[0], test.warning) {
+				t.Fatalf("expected warning %v, got %v", test.warning, warnings)
+			}
+		})
+	}
+}
+
+func TestMissingContract(t *testing.T) {
+	// a contract missing from the answer is an upstream failure, so the
+	// degradation policy applies to it
+	cache := newContractCache(10, time.Hour, time.Hour, 0)
+	_, err := cache.getMany(context.Background(), []lookup{{Artist: "Drake"}}, func(ctx context.Context, lookups []lookup) (map[lookup]contract, error) {
+		return map[lookup]contract{}, nil
+	})
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) || statusErr.status != http.StatusBadGateway {
+		t.Fatalf("expected a 502, got %v", err)
+	}
+}
+
+// contractsServer answers batches of lookups as the contracts service does,
+// failing the first failures calls, and records the batches it was sent.
+func contractsServer(t *testing.T, failures int32) (*httptest.Server, func() [][]lookup) {
+	var mutex sync.Mutex
+	var calls int32
+	batches := [][]lookup{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Lookups []lookup `json:"lookups"`
+		}
+		if r.Method != "POST" || r.URL.Path != "/batch" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			t.Errorf("unexpected contracts request %v %v", r.Method, r.URL)
+		}
+		mutex.Lock()
+		batches = append(batches, body.Lookups)
+		mutex.Unlock()
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		found := []contract{}
+		for _, l := range body.Lookups {
+			found = append(found, contract{Artist: l.Artist, Payment: 0.1, Source: "contract"})
+		}
+		json.NewEncoder(w).Encode(found)
+	}))
+	return server, func() [][]lookup {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return batches
+	}
+}
+
+func TestContractBatching(t *testing.T) {
+	server, batches := contractsServer(t, 1)
+	defer server.Close()
+	contractsService = testUpstream(server, 2, 0, 0)
+	contracts = newContractCache(10, time.Hour, time.Hour, 0)
+	songs := []map[string]interface{}{
+		{"artist": "Drake", "genre": "HipHop"},
+		{"artist": "DRAKE ", "genre": "hiphop"},
+		{"artist": "Drake", "genre": "HipHop"},
+		{"artist": "Tyga", "genre": "HipHop"},
+		{"title": "No Artist"},
+	}
+
+	// the songs are enriched by one batch, which is retried when it fails
+	warnings, err := addPayments(context.Background(), songs, false)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("expected the songs to be enriched, got %v - %v", warnings, err)
+	}
+	sent := batches()
+	if len(sent) != 2 {
+		t.Fatalf("expected one batch and one retry, got %v", sent)
+	}
+	if len(sent[1]) != 2 || sent[1][0].Artist != "Drake" || sent[1][1].Artist != "Tyga" {
+		t.Fatalf("expected Drake and Tyga to be asked for once each, got %+v", sent[1])
+	}
+	for _, song := range songs[:4] {
+		if song["payment"] != 0.1 {
+			t.Fatalf("expected every song with an artist to be paid, got %+v", song)
+		}
+	}
+	if _, ok := songs[4]["payment"]; ok {
+		t.Fatalf("expected the song without an artist to be left alone, got %+v", songs[4])
+	}
+
+	// without the cache only the same lookups are merged
+	contracts = newContractCache(0, time.Hour, time.Hour, 0)
+	addPayments(context.Background(), songs, false)
+	if sent = batches(); len(sent) != 3 || len(sent[2]) != 3 {
+		t.Fatalf("expected a batch of 3 lookups, got %+v", sent)
+	}
+}
+
+func TestDefaultAndStrictPayments(t *testing.T) {
+	// Drake has a contract, Tyga is paid the default and, as under a strict
+	// policy, Nobody has no contract at all
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Lookups []lookup `json:"lookups"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		found := []*contract{}
+		for _, l := range body.Lookups {
+			switch l.Artist {
+			case "Drake":
+				found = append(found, &contract{Artist: l.Artist, Payment: 0.2, Source: "contract"})
+			case "Tyga":
+				found = append(found, &contract{Artist: l.Artist, Payment: 0.05, Default: true, Source: "default"})
+			default:
+				found = append(found, nil)
+			}
+		}
+		json.NewEncoder(w).Encode(found)
+	}))
+	defer server.Close()
+	contractsService = testUpstream(server, 0, 0, 0)
+	contracts = newContractCache(10, time.Hour, time.Hour, 0)
+
+	songs := []map[string]interface{}{{"artist": "Drake"}, {"artist": "Tyga"}, {"artist": "Nobody"}}
+	warnings, err := addPayments(context.Background(), songs, false)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("expected the songs to be enriched, got %v - %v", warnings, err)
+	}
+	if songs[0]["payment"] != 0.2 || songs[0]["defaultContract"] != false {
+		t.Fatalf("expected Drake to be paid by contract, got %+v", songs[0])
+	}
+	if songs[1]["payment"] != 0.05 || songs[1]["defaultContract"] != true {
+		t.Fatalf("expected Tyga to be marked as paid by default, got %+v", songs[1])
+	}
+	if payment, ok := songs[2]["payment"]; !ok || payment != nil {
+		t.Fatalf("expected Nobody to have a null payment, got %+v", songs[2])
+	}
+	body, _ := json.Marshal(songs[2])
+	if string(body) != `{"artist":"Nobody","payment":null}` {
+		t.Fatalf("expected a null payment in the response, got %s", body)
+	}
+}
+
+func TestRichPaymentVersion(t *testing.T) {
+	var songsVersion string
+	songs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		songsVersion = r.Header.Get("x-api-version")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"1","artist":"Drake","genre":"HipHop"}`))
+	}))
+	defer songs.Close()
+	server, _ := contractsServer(t, 0)
+	defer server.Close()
+	songsService = testUpstream(songs, 0, 0, 0)
+	contractsService = testUpstream(server, 0, 0, 0)
+	contracts = newContractCache(10, time.Hour, time.Hour, 0)
+
+	// the handler is called without the metrics middleware in front of it
+	tests := map[string]string{
+		"":   `{"artist":"Drake","defaultContract":false,"genre":"HipHop","id":"1","payment":0.1}`,
+		"v2": `{"artist":"Drake","defaultContract":false,"genre":"HipHop","id":"1","payment":0.1}`,
+		"v3": `{"artist":"Drake","genre":"HipHop","id":"1","payment":{"rate":0.1,"default":false,"source":"contract"}}`,
+	}
+	for version, expected := range tests {
+		req := httptest.NewRequest("GET", "/song?id=1", nil)
+		if version != "" {
+			req.Header.Set("x-api-version", version)
+		}
+		w := httptest.NewRecorder()
+		retrieveSong(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Fatalf("expected %v for version %q, got %v: %v", expected, version, w.Code, w.Body.String())
+		}
+		if version == richPaymentVersion && songsVersion != "v2" {
+			t.Fatalf("expected the songs of v2 to be asked for, got %q", songsVersion)
+		}
+	}
+}
+
+func TestSearchSongs(t *testing.T) {
+	var query string
+	songsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/search" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.RawQuery
+		io.WriteString(w, `{"items":[{"id":6,"artist":"Juice WRLD","title":"Lucid Dreams","genre":"Rap","score":2.5}]}`)
+	}))
+	defer songsServer.Close()
+	contractsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"artist":"Juice WRLD","payment":0.2}]`)
+	}))
+	defer contractsServer.Close()
+	songsService = newUpstream("songs", "TEST_SONGS", songsServer.URL, time.Second)
+	contractsService = newUpstream("contracts", "TEST_CONTRACTS", contractsServer.URL, time.Second)
+	contracts = newContractCache(10, time.Hour, time.Hour, 0)
+
+	// the query is passed on and the hits are paid from the contracts
+	w := httptest.NewRecorder()
+	searchSongs(w, httptest.NewRequest("GET", "/search?q=dreams&limit=5", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	if query != "q=dreams&limit=5" {
+		t.Fatalf("expected the query to be passed on, got %v", query)
+	}
+	var result struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 1 || result.Items[0]["title"] != "Lucid Dreams" || result.Items[0]["payment"] != 0.2 || result.Items[0]["score"] != 2.5 {
+		t.Fatalf("expected the paid hit, got %+v", result.Items)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_requests_total",
+		Help: "The number of calls made to each upstream service, by method and outcome.",
+	}, []string{"upstream", "method", "status", "api_version"})
+	upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upstream_request_duration_seconds",
+		Help:    "How long calls to each upstream service took, by method and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream", "method", "status", "api_version"})
+	contractCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contract_cache_lookups_total",
+		Help: "The number of contract lookups, by whether the cache had them fresh, stale or not at all.",
+	}, []string{"result"})
+	contractCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contract_cache_evictions_total",
+		Help: "The number of contracts dropped from the cache to keep it within its size.",
+	})
+	contractCacheErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contract_cache_errors_total",
+		Help: "The number of contracts that could not be fetched into the cache.",
+	})
+	contractCacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "contract_cache_entries",
+		Help: "The number of contracts in the cache.",
+	})
+)
+
+// observeUpstream records one call to an upstream service; status is the
+// response status or why there wasn't one.
+func observeUpstream(req *http.Request, name, status string, start time.Time) {
+	labels := prometheus.Labels{"upstream": name, "method": req.Method, "status": status, "api_version": platform.ApiVersionFrom(req.Context())}
+	upstreamRequestsTotal.With(labels).Inc()
+	upstreamRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrAliasTaken is returned when a name is already another artist's, either
+// as an alias or as the name of an artist with aliases of their own.
+var ErrAliasTaken = errors.New("the name belongs to another artist")
+
+// ErrNotAlias is returned when a name that isn't an alias is removed.
+var ErrNotAlias = errors.New("the name is not an alias")
+
+// ErrHasContracts is returned when a name with contracts of its own would
+// become an alias; its contracts would no longer be found.
+var ErrHasContracts = errors.New("the name has contracts of its own")
+
+// errNowAlias is returned from a change when the artist became an alias after
+// they were resolved, so that the change is made again under the artist.
+var errNowAlias = errors.New("the artist became an alias")
+
+// alias is another name an artist is known by, such as the name an artist
+// used to go by. It is stored under the artistKey of the alias and refers to
+// the artist by their canonical name.
+type alias struct {
+	Key       string `bson:"_id"`
+	Name      string `bson:"name"`
+	Artist    string `bson:"artist"`
+	ArtistKey string `bson:"artistKey"`
+}
+
+// artistRecord is an artist under their canonical name, which is what their
+// contracts are stored under, and the aliases that resolve to it.
+type artistRecord struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+}
+
+// newArtistRecord makes the record of the artist from their aliases.
+func newArtistRecord(artist string, aliases []alias) artistRecord {
+	record := artistRecord{Name: artist, Aliases: []string{}}
+	for _, a := range aliases {
+		record.Name = a.Artist
+		record.Aliases = append(record.Aliases, a.Name)
+	}
+	return record
+}
+
+// ArtistStore is the storage backend for the identities of artists. Names
+// are matched by artistKey, so only names that differ by more than that need
+// an alias.
+type ArtistStore interface {
+	// Canonical returns the canonical name of each artist, keyed by the
+	// artist as given. A name that isn't an alias is its own canonical name.
+	Canonical(ctx context.Context, artists []string) (map[string]string, error)
+
+	// Artist returns the record of the artist that the name is, or is an
+	// alias of.
+	Artist(ctx context.Context, name string) (artistRecord, error)
+
+	// AddAlias makes the name an alias of the artist, or of the artist they
+	// are an alias of, and returns the artist's record.
+	AddAlias(ctx context.Context, artist, name string) (artistRecord, error)
+
+	// RemoveAlias stops the name being an alias and returns the record of the
+	// artist it was an alias of.
+	RemoveAlias(ctx context.Context, name string) (artistRecord, error)
+}
+
+// resolvingStore keeps contracts under the canonical names of artists so
+// that an artist's contracts are found by any of their aliases.
+type resolvingStore struct {
+	contracts ContractStore
+	artists   ArtistStore
+}
+
+func newResolvingStore(contracts ContractStore, artists ArtistStore) *resolvingStore {
+	return &resolvingStore{contracts: contracts, artists: artists}
+}
+
+func (s *resolvingStore) canonical(ctx context.Context, artist string) (string, error) {
+	names, err := s.artists.Canonical(ctx, []string{artist})
+	if err != nil {
+		return "", err
+	}
+	return names[artist], nil
+}
+
+func (s *resolvingStore) History(ctx context.Context, artist string) ([]contract, error) {
+	name, err := s.canonical(ctx, artist)
+	if err != nil {
+		return nil, err
+	}
+	return s.contracts.History(ctx, name)
+}
+
+func (s *resolvingStore) HistoryMany(ctx context.Context, artists []string) (map[string][]contract, error) {
+	names, err := s.artists.Canonical(ctx, artists)
+	if err != nil {
+		return nil, err
+	}
+	canonical := make([]string, 0, len(names))
+	for _, name := range names {
+		canonical = append(canonical, name)
+	}
+	histories, err := s.contracts.HistoryMany(ctx, canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	// the histories are returned under the artists as they were asked for
+	found := map[string][]contract{}
+	for _, artist := range artists {
+		if history, ok := histories[names[artist]]; ok {
+			found[artist] = history
+		}
+	}
+	return found, nil
+}
+
+func (s *resolvingStore) Change(ctx context.Context, artist string, change func(history []contract) ([]contract, error)) error {
+	for attempt := 0; attempt < maxChangeAttempts; attempt++ {
+		name, err := s.canonical(ctx, artist)
+		if err != nil {
+			return err
+		}
+		err = s.contracts.Change(ctx, name, func(history []contract) ([]contract, error) {
+			// adding an alias is a change to the contracts under the name, so
+			// one added since the artist was resolved is seen here
+			now, err := s.canonical(ctx, artist)
+			if err != nil {
+				return nil, err
+			}
+			if artistKey(now) != artistKey(name) {
+				return nil, errNowAlias
+			}
+			return change(history)
+		})
+		if err != errNowAlias {
+			return err
+		}
+	}
+	return errNowAlias
+}
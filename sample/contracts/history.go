@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+)
+
+// inForce reports whether the contract applies at the moment.
+func (c contract) inForce(at time.Time) bool {
+	return (c.EffectiveFrom == nil || !at.Before(*c.EffectiveFrom)) && (c.EffectiveTo == nil || at.Before(*c.EffectiveTo))
+}
+
+// contractAt returns the contract in force at the moment, if there is one.
+func contractAt(history []contract, at time.Time) (contract, bool) {
+	for _, val := range history {
+		if val.inForce(at) {
+			return val, true
+		}
+	}
+	return contract{}, false
+}
+
+// addContract adds a contract that takes effect after every other, ending
+// the latest one when the new one takes effect if it hasn't ended already.
+func addContract(history []contract, val contract) ([]contract, error) {
+	if len(history) > 0 {
+		latest := &history[len(history)-1]
+		if latest.EffectiveFrom != nil && !val.EffectiveFrom.After(*latest.EffectiveFrom) {
+			return history, ErrOverlap
+		}
+		if latest.EffectiveTo == nil || latest.EffectiveTo.After(*val.EffectiveFrom) {
+			latest.EffectiveTo = val.EffectiveFrom
+		}
+	}
+	return append(history, val), nil
+}
+
+// correctContract replaces the terms of the contract in force at the moment,
+// and the artist too if one is given, without changing when it applies.
+func correctContract(history []contract, at time.Time, val contract) ([]contract, contract, error) {
+	for i := range history {
+		if history[i].inForce(at) {
+			history[i].Payment = val.Payment
+			history[i].Tiers = val.Tiers
+			history[i].Splits = val.Splits
+			if val.Artist != "" {
+				history[i].Artist = val.Artist
+			}
+			return history, history[i], nil
+		}
+	}
+	return history, contract{}, ErrNotFound
+}
+
+// endContract ends the contract in force at the moment. A contract that
+// would take effect at the moment is removed, as it would never apply, but
+// contracts due to take effect after it are not dropped; ErrScheduled is
+// returned instead, so that they are ended first, latest first.
+func endContract(history []contract, at time.Time) ([]contract, error) {
+	kept := []contract{}
+	ended := false
+	for _, val := range history {
+		if val.EffectiveFrom != nil && val.EffectiveFrom.After(at) {
+			return history, ErrScheduled
+		}
+		if val.EffectiveFrom != nil && val.EffectiveFrom.Equal(at) {
+			ended = true
+			continue
+		}
+		if val.inForce(at) {
+			val.EffectiveTo = &at
+			ended = true
+		}
+		kept = append(kept, val)
+	}
+	if !ended {
+		return history, ErrNotFound
+	}
+	return kept, nil
+}
@@ -1,74 +1,695 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/plasne/aks-lab/sample/platform"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
+// contract is what an artist is paid from effectiveFrom until effectiveTo;
+// either end can be left open. Lookups say whether it is the artist's own
+// contract or a default in source. With tiers the payment is that of the
+// first tier; with splits the payout is shared between the parties.
 type contract struct {
-	Artist  string  `json:"artist"`
-	Payment float64 `json:"payment"`
+	Artist        string     `json:"artist" bson:"artist"`
+	Payment       float64    `json:"payment" bson:"payment"`
+	Default       bool       `json:"default,omitempty" bson:"-"`
+	Source        string     `json:"source,omitempty" bson:"-"`
+	Tiers         []tier     `json:"tiers,omitempty" bson:"tiers,omitempty"`
+	Splits        []split    `json:"splits,omitempty" bson:"splits,omitempty"`
+	EffectiveFrom *time.Time `json:"effectiveFrom,omitempty" bson:"effectiveFrom,omitempty"`
+	EffectiveTo   *time.Time `json:"effectiveTo,omitempty" bson:"effectiveTo,omitempty"`
 }
 
+// the contracts an empty store starts with.
 var contracts = []contract{
-	{"Drake", 0.2},
-	{"Taylor Swift", 0.25},
-	{"Khalid & Normani", 0.1},
+	{Artist: "Drake", Payment: 0.2},
+	{Artist: "Taylor Swift", Payment: 0.25},
+	{Artist: "Khalid & Normani", Payment: 0.1, Splits: []split{{"Khalid", 0.5}, {"Normani", 0.5}}},
 }
 
-func getContractForArtist(w http.ResponseWriter, r *http.Request) {
-	// see if the artist has a contract
+// the most artists that can be looked up in one batch.
+const maxBatchSize = 1000
+
+// validateContract returns why the contract can't be stored, if it can't.
+func validateContract(val contract) string {
+	if strings.TrimSpace(val.Artist) == "" {
+		return "the artist is required."
+	}
+	if val.Payment < 0 || val.Payment > 1 {
+		return "the payment must be between 0 and 1."
+	}
+	if val.EffectiveFrom != nil && val.EffectiveTo != nil && !val.EffectiveTo.After(*val.EffectiveFrom) {
+		return "effectiveTo must be after effectiveFrom."
+	}
+	return validateTerms(val)
+}
+
+// parseAt returns the moment asked for with ?at=, or now if there isn't one.
+func parseAt(r *http.Request) (time.Time, error) {
+	at := r.URL.Query().Get("at")
+	if at == "" {
+		return time.Now().UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, at)
+}
+
+// contractLocation is where the artist's contract that takes effect at the
+// moment can be retrieved.
+func contractLocation(artist string, at time.Time) string {
+	return "/?" + url.Values{"artist": {artist}, "at": {at.Format(time.RFC3339Nano)}}.Encode()
+}
+
+// writeJSON writes the value as JSON with the status.
+func writeJSON(w http.ResponseWriter, r *http.Request, val interface{}, status int) {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		platform.HttpError(w, "the contract could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contract could not be marshalled - %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.LoggerFor(r.Context()).Errorf("the contract could not be written - %v", err)
+	}
+}
+
+func getContractForArtist(w http.ResponseWriter, r *http.Request, contractStore ContractStore) {
 	artist := r.URL.Query().Get("artist")
-	var found *contract
-	for _, contract := range contracts {
-		if strings.EqualFold(contract.Artist, artist) {
-			found = &contract
-			break
+	at, err := parseAt(r)
+	if err != nil {
+		platform.HttpError(w, "at must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+
+	// see if the artist had a contract at the time
+	history, err := contractStore.History(r.Context(), artist)
+	if err != nil {
+		platform.HttpError(w, "the contract could not be retrieved.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contract could not be retrieved - %v", err)
+		return
+	}
+	found, ok := policy.resolve(history, artist, r.URL.Query().Get("genre"), at)
+	if !ok {
+		platform.HttpError(w, "the artist has no contract.", http.StatusNotFound)
+		platform.LoggerFor(r.Context()).Infof("artist \"%v\" has no contract at %v.", artist, at.Format(time.RFC3339))
+		return
+	}
+
+	// write JSON output
+	platform.LoggerFor(r.Context()).Infof("artist \"%v\" is paid \"%v\" at %v.", artist, found.Payment, at.Format(time.RFC3339))
+	writeJSON(w, r, found, http.StatusOK)
+}
+
+// lookup asks for the contract of an artist for a song in a genre; the
+// genre only matters to artists without a contract.
+type lookup struct {
+	Artist string `json:"artist"`
+	Genre  string `json:"genre"`
+}
+
+// getContractsForArtists looks up many artists at once. Artists given as
+// repeated query parameters or as a list of artists are answered with a map
+// of artist to contract; under a strict policy artists without a contract
+// are left out. A list of lookups, which can give a genre for each, is
+// answered with a list in the same order that has null for those artists.
+func getContractsForArtists(w http.ResponseWriter, r *http.Request, contractStore ContractStore) {
+	at, err := parseAt(r)
+	if err != nil {
+		platform.HttpError(w, "at must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+
+	// the artists are repeated query parameters or a list in the body
+	artists := r.URL.Query()["artist"]
+	var lookups []lookup
+	if r.Method == "POST" {
+		var body struct {
+			Artists []string `json:"artists"`
+			Lookups []lookup `json:"lookups"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			platform.HttpError(w, "the body must be a list of artists or lookups.", http.StatusBadRequest)
+			return
 		}
+		artists = append(artists, body.Artists...)
+		lookups = body.Lookups
+	}
+	if len(artists)+len(lookups) > maxBatchSize {
+		platform.HttpError(w, fmt.Sprint("no more than ", maxBatchSize, " artists can be looked up at once."), http.StatusBadRequest)
+		return
+	}
+	for _, l := range lookups {
+		artists = append(artists, l.Artist)
 	}
 
-	// create a standard contract if necessary
-	if found == nil {
-		found = &contract{artist, 0.05}
+	// find the contract for each artist
+	histories, err := contractStore.HistoryMany(r.Context(), artists)
+	if err != nil {
+		platform.HttpError(w, "the contracts could not be retrieved.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contracts could not be retrieved - %v", err)
+		return
+	}
+	var result interface{}
+	if lookups != nil {
+		found := make([]*contract, len(lookups))
+		for i, l := range lookups {
+			if val, ok := policy.resolve(histories[l.Artist], l.Artist, l.Genre, at); ok {
+				found[i] = &val
+			}
+		}
+		result = found
+	} else {
+		found := make(map[string]contract, len(artists))
+		for _, artist := range artists {
+			if val, ok := policy.resolve(histories[artist], artist, "", at); ok {
+				found[artist] = val
+			}
+		}
+		result = found
 	}
 
 	// write JSON output
-	log.Printf("artist \"%v\" is paid \"%v\".\n", artist, found.Payment)
-	bytes, err := json.Marshal(found)
+	platform.LoggerFor(r.Context()).Infof("looked up contracts for %v artists.", len(artists))
+	bytes, err := json.Marshal(result)
 	if err != nil {
-		http.Error(w, "the song could not be marshalled.", http.StatusInternalServerError)
+		platform.HttpError(w, "the contracts could not be marshalled.", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	_, err = w.Write(bytes)
 	if err != nil {
-		http.Error(w, "the song could not be written.", http.StatusInternalServerError)
+		platform.HttpError(w, "the contracts could not be written.", http.StatusInternalServerError)
 		return
 	}
 }
 
-func main() {
-	godotenv.Load()
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+func getHistoryForArtist(w http.ResponseWriter, r *http.Request, contractStore ContractStore) {
+	artist := r.URL.Query().Get("artist")
+	if artist == "" {
+		platform.HttpError(w, "an artist must be provided.", http.StatusBadRequest)
+		return
+	}
+	history, err := contractStore.History(r.Context(), artist)
+	if err != nil {
+		platform.HttpError(w, "the contracts could not be retrieved.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contracts could not be retrieved - %v", err)
+		return
+	}
+	if history == nil {
+		history = []contract{}
+	}
+	platform.LoggerFor(r.Context()).Infof("artist \"%v\" has had %v contracts.", artist, len(history))
+	writeJSON(w, r, history, http.StatusOK)
+}
+
+func getPayoutForArtist(w http.ResponseWriter, r *http.Request, contractStore ContractStore) {
+	artist := r.URL.Query().Get("artist")
+	if artist == "" {
+		platform.HttpError(w, "an artist must be provided.", http.StatusBadRequest)
+		return
+	}
+	plays, err := strconv.ParseInt(r.URL.Query().Get("plays"), 10, 64)
+	if err != nil || plays < 0 {
+		platform.HttpError(w, "plays must be a count of zero or more.", http.StatusBadRequest)
+		return
+	}
+	at, err := parseAt(r)
+	if err != nil {
+		platform.HttpError(w, "at must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+
+	// pay the plays by the contract in force at the time
+	history, err := contractStore.History(r.Context(), artist)
+	if err != nil {
+		platform.HttpError(w, "the contract could not be retrieved.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contract could not be retrieved - %v", err)
+		return
+	}
+	found, ok := policy.resolve(history, artist, r.URL.Query().Get("genre"), at)
+	if !ok {
+		platform.HttpError(w, "the artist has no contract.", http.StatusNotFound)
+		return
+	}
+	result := computePayout(found, plays)
+
+	platform.LoggerFor(r.Context()).Infof("artist \"%v\" is paid \"%v\" for %v plays.", artist, result.Amount, plays)
+	writeJSON(w, r, result, http.StatusOK)
+}
+
+func storeContract(w http.ResponseWriter, r *http.Request, contractStore ContractStore, artistStore ArtistStore) {
+	// read the contract; it takes effect now unless it says otherwise
+	var val contract
+	err := json.NewDecoder(r.Body).Decode(&val)
+	if err != nil {
+		platform.HttpError(w, "the body must be a contract.", http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("the contract could not be read - %v", err)
+		return
+	}
+	val.Default = false
+	val.Source = ""
+	if len(val.Tiers) > 0 {
+		val.Payment = val.Tiers[0].Payment
+	}
+	if val.EffectiveFrom == nil {
+		now := time.Now()
+		val.EffectiveFrom = &now
+	}
+
+	// times are kept to the millisecond, as Mongo does
+	from := val.EffectiveFrom.UTC().Truncate(time.Millisecond)
+	val.EffectiveFrom = &from
+	if val.EffectiveTo != nil {
+		to := val.EffectiveTo.UTC().Truncate(time.Millisecond)
+		val.EffectiveTo = &to
+	}
+	if reason := validateContract(val); reason != "" {
+		platform.HttpError(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	// contracts made under an alias are kept under the artist's canonical
+	// name, which is what the history is stored under
+	names, err := artistStore.Canonical(r.Context(), []string{val.Artist})
+	if err != nil {
+		platform.HttpError(w, "the contract could not be stored.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contract could not be stored - %v", err)
+		return
+	}
+	val.Artist = names[val.Artist]
+
+	// add it to the end of the artist's history
+	err = contractStore.Change(r.Context(), val.Artist, func(history []contract) ([]contract, error) {
+		return addContract(history, val)
+	})
+	if err == ErrOverlap {
+		platform.HttpError(w, "the contract must take effect after the artist's latest contract.", http.StatusConflict)
+		platform.LoggerFor(r.Context()).Warnf("the contract for artist \"%v\" overlaps their latest one.", val.Artist)
+		return
+	} else if err != nil {
+		platform.HttpError(w, "the contract could not be stored.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contract could not be stored - %v", err)
+		return
+	}
+
+	platform.LoggerFor(r.Context()).Infof("stored the contract for artist \"%v\" paying \"%v\" from %v.", val.Artist, val.Payment, val.EffectiveFrom.Format(time.RFC3339))
+	w.Header().Set("Location", contractLocation(val.Artist, *val.EffectiveFrom))
+	writeJSON(w, r, val, http.StatusCreated)
+}
+
+func updateContract(w http.ResponseWriter, r *http.Request, contractStore ContractStore, artistStore ArtistStore) {
+	artist := r.URL.Query().Get("artist")
+	if artist == "" {
+		platform.HttpError(w, "an artist must be provided.", http.StatusBadRequest)
+		return
+	}
+	at, err := parseAt(r)
+	if err != nil {
+		platform.HttpError(w, "at must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+
+	// read the correction, which replaces the terms of the contract; the
+	// artist's canonical name can only be changed in case or spacing and when
+	// a contract applies can't be changed at all
+	var body struct {
+		Artist        string     `json:"artist"`
+		Payment       *float64   `json:"payment"`
+		Tiers         []tier     `json:"tiers"`
+		Splits        []split    `json:"splits"`
+		EffectiveFrom *time.Time `json:"effectiveFrom"`
+		EffectiveTo   *time.Time `json:"effectiveTo"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		platform.HttpError(w, "the body must be a contract.", http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("the contract could not be read - %v", err)
+		return
+	}
+	if body.Artist != "" {
+		names, err := artistStore.Canonical(r.Context(), []string{artist})
+		if err != nil {
+			platform.HttpError(w, "the contract could not be updated.", http.StatusInternalServerError)
+			platform.LoggerFor(r.Context()).Errorf("the contract could not be updated - %v", err)
+			return
+		}
+		if artistKey(body.Artist) != artistKey(names[artist]) {
+			platform.HttpError(w, "the artist in the body must be the canonical name of the artist being updated.", http.StatusBadRequest)
+			return
+		}
+	}
+	if body.EffectiveFrom != nil || body.EffectiveTo != nil {
+		platform.HttpError(w, "when a contract applies can't be changed; store a new contract instead.", http.StatusBadRequest)
+		return
+	}
+	val := contract{Artist: body.Artist, Tiers: body.Tiers, Splits: body.Splits}
+	switch {
+	case len(body.Tiers) > 0:
+		val.Payment = body.Tiers[0].Payment
+	case body.Payment != nil:
+		val.Payment = *body.Payment
+	default:
+		platform.HttpError(w, "the payment or tiers are required.", http.StatusBadRequest)
+		return
+	}
+	if reason := validateContract(contract{Artist: artist, Payment: val.Payment, Tiers: val.Tiers, Splits: val.Splits}); reason != "" {
+		platform.HttpError(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	// correct the contract that was in force at the time
+	var corrected contract
+	err = contractStore.Change(r.Context(), artist, func(history []contract) ([]contract, error) {
+		var err error
+		history, corrected, err = correctContract(history, at, val)
+		return history, err
+	})
+	if err == ErrNotFound {
+		platform.HttpError(w, "the artist has no contract at that time.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		platform.HttpError(w, "the contract could not be updated.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contract could not be updated - %v", err)
+		return
+	}
+
+	platform.LoggerFor(r.Context()).Infof("updated the contract for artist \"%v\" to pay \"%v\".", corrected.Artist, corrected.Payment)
+	writeJSON(w, r, corrected, http.StatusOK)
+}
+
+func removeContract(w http.ResponseWriter, r *http.Request, contractStore ContractStore) {
+	artist := r.URL.Query().Get("artist")
+	if artist == "" {
+		platform.HttpError(w, "an artist must be provided.", http.StatusBadRequest)
+		return
+	}
+	at, err := parseAt(r)
+	if err != nil {
+		platform.HttpError(w, "at must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+
+	// the contract is ended rather than forgotten so that the history stays
+	err = contractStore.Change(r.Context(), artist, func(history []contract) ([]contract, error) {
+		return endContract(history, at)
+	})
+	if err == ErrNotFound {
+		platform.HttpError(w, "the artist has no contract at that time.", http.StatusNotFound)
+		return
+	} else if err == ErrScheduled {
+		platform.HttpError(w, "the artist has contracts that take effect later; end those first.", http.StatusConflict)
+		platform.LoggerFor(r.Context()).Warnf("the contract for artist \"%v\" can't be ended while later ones are scheduled.", artist)
+		return
+	} else if err != nil {
+		platform.HttpError(w, "the contract could not be ended.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the contract could not be ended - %v", err)
+		return
+	}
+
+	platform.LoggerFor(r.Context()).Infof("ended the contract for artist \"%v\" at %v.", artist, at.Format(time.RFC3339))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getArtist(w http.ResponseWriter, r *http.Request, artistStore ArtistStore) {
+	name := r.URL.Query().Get("artist")
+	if artistKey(name) == "" {
+		platform.HttpError(w, "an artist must be provided.", http.StatusBadRequest)
+		return
+	}
+	record, err := artistStore.Artist(r.Context(), name)
+	if err != nil {
+		platform.HttpError(w, "the artist could not be retrieved.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the artist could not be retrieved - %v", err)
+		return
+	}
+	platform.LoggerFor(r.Context()).Infof("artist \"%v\" is \"%v\", who has %v aliases.", name, record.Name, len(record.Aliases))
+	writeJSON(w, r, record, http.StatusOK)
+}
+
+// addAlias makes a name an alias of an artist. Contracts are kept under the
+// artist's canonical name, so a name that has contracts of its own can't
+// become an alias; they would no longer be found.
+func addAlias(w http.ResponseWriter, r *http.Request, artistStore ArtistStore, contractStore ContractStore) {
+	var body struct {
+		Artist string `json:"artist"`
+		Alias  string `json:"alias"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		platform.HttpError(w, "the body must be an artist and an alias.", http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("the alias could not be read - %v", err)
+		return
+	}
+	if artistKey(body.Artist) == "" || artistKey(body.Alias) == "" {
+		platform.HttpError(w, "an artist and an alias must be provided.", http.StatusBadRequest)
+		return
+	}
+
+	// a name that is its own artist mustn't have contracts; the alias is added
+	// as a change to the contracts under the name so that none can be stored
+	// under it in the meantime
+	names, err := artistStore.Canonical(r.Context(), []string{body.Artist, body.Alias})
+	if err != nil {
+		platform.HttpError(w, "the alias could not be added.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the alias could not be added - %v", err)
+		return
+	}
+	ownArtist := artistKey(names[body.Alias]) == artistKey(body.Alias) && artistKey(names[body.Artist]) != artistKey(body.Alias)
+	var record artistRecord
+	added := false
+	err = contractStore.Change(r.Context(), body.Alias, func(history []contract) ([]contract, error) {
+		if ownArtist && len(history) > 0 {
+			return history, ErrHasContracts
+		}
+		if added {
+			return history, nil
+		}
+		var err error
+		record, err = artistStore.AddAlias(r.Context(), body.Artist, body.Alias)
+		added = err == nil
+		return history, err
+	})
+
+	// a change that was retried can find contracts stored since the alias
+	// was added, in which case it is taken back
+	if err != nil && added {
+		if _, removeErr := artistStore.RemoveAlias(r.Context(), body.Alias); removeErr != nil {
+			platform.LoggerFor(r.Context()).Errorf("the alias \"%v\" could not be taken back - %v", body.Alias, removeErr)
+		}
+	}
+	if err == ErrHasContracts {
+		platform.HttpError(w, "the alias has contracts of its own.", http.StatusConflict)
+		platform.LoggerFor(r.Context()).Warnf("\"%v\" can't be an alias of \"%v\" as it has contracts.", body.Alias, body.Artist)
+		return
+	} else if err == ErrAliasTaken {
+		platform.HttpError(w, "the alias belongs to another artist.", http.StatusConflict)
+		platform.LoggerFor(r.Context()).Warnf("\"%v\" can't be an alias of \"%v\" as it belongs to another artist.", body.Alias, body.Artist)
+		return
+	} else if err != nil {
+		platform.HttpError(w, "the alias could not be added.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the alias could not be added - %v", err)
+		return
+	}
+
+	platform.LoggerFor(r.Context()).Infof("\"%v\" is an alias of artist \"%v\".", body.Alias, record.Name)
+	w.Header().Set("Location", fmt.Sprint("/artists?artist=", url.QueryEscape(record.Name)))
+	writeJSON(w, r, record, http.StatusCreated)
+}
+
+func removeAlias(w http.ResponseWriter, r *http.Request, artistStore ArtistStore) {
+	name := r.URL.Query().Get("alias")
+	if artistKey(name) == "" {
+		platform.HttpError(w, "an alias must be provided.", http.StatusBadRequest)
+		return
+	}
+	record, err := artistStore.RemoveAlias(r.Context(), name)
+	if err == ErrNotAlias {
+		platform.HttpError(w, "the name is not an alias.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		platform.HttpError(w, "the alias could not be removed.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the alias could not be removed - %v", err)
+		return
+	}
+	platform.LoggerFor(r.Context()).Infof("\"%v\" is no longer an alias of artist \"%v\".", name, record.Name)
+	writeJSON(w, r, record, http.StatusOK)
+}
+
+// newHandler routes the contract and artist endpoints; contracts are looked
+// up by any name the artist is known by.
+func newHandler(contractStore ContractStore, artistStore ArtistStore) *http.ServeMux {
+	artistContracts := newResolvingStore(contractStore, artistStore)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			getContractForArtist(w, r, artistContracts)
+		case "POST":
+			storeContract(w, r, artistContracts, artistStore)
+		case "PUT":
+			updateContract(w, r, artistContracts, artistStore)
+		case "DELETE":
+			removeContract(w, r, artistContracts)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/payout", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			getPayoutForArtist(w, r, artistContracts)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			getHistoryForArtist(w, r, artistContracts)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/batch", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "POST":
+			getContractsForArtists(w, r, artistContracts)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/artists", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
-			getContractForArtist(w, r)
+			getArtist(w, r, artistStore)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/artists/aliases", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			addAlias(w, r, artistStore, contractStore)
+		case "DELETE":
+			removeAlias(w, r, artistStore)
 		default:
-			http.Error(w, "the method is not implemented.", http.StatusNotImplemented)
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
 		}
 	})
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+func main() {
+	godotenv.Load()
+	if err := platform.SetupLogging("contracts"); err != nil {
+		platform.ServiceLog.Fatalf("unable to set up logging - %v", err)
+	}
+	shutdown, err := platform.SetupTracing(context.Background(), "contracts")
+	if err != nil {
+		platform.ServiceLog.Fatalf("unable to set up tracing - %v", err)
+	}
+	defer shutdown(context.Background())
+
+	// decide what artists without a contract are paid
+	policy, err = loadDefaultPolicy()
+	if err != nil {
+		platform.ServiceLog.Fatalf("unable to load the default contract policy - %v", err)
+	}
+	platform.ServiceLog.Infof("artists without a contract are paid by the %v policy...", policy.name)
+
+	// create the stores; contracts were only ever kept in memory before they
+	// could be kept in Mongo, so memory is still the default
+	var contractStore ContractStore
+	var artistStore ArtistStore
+	storeBackend := os.Getenv("STORE_BACKEND")
+	if storeBackend == "" {
+		storeBackend = "memory"
+	}
+	switch storeBackend {
+	case "memory":
+		contractStore = newMemoryStore(contracts)
+		artistStore = newMemoryArtistStore()
+	case "mongo":
+		mongoConnString := os.Getenv("MONGO_CONNSTRING")
+		if mongoConnString == "" {
+			platform.ServiceLog.Fatalf("You must provide MONGO_CONNSTRING.")
+		}
+		mongoDatabase := os.Getenv("MONGO_DATABASE")
+		if mongoDatabase == "" {
+			mongoDatabase = "db"
+		}
+		mongoCollection := os.Getenv("MONGO_COLLECTION")
+		if mongoCollection == "" {
+			mongoCollection = "contracts"
+		}
+		mongoArtistsCollection := os.Getenv("MONGO_ARTISTS_COLLECTION")
+		if mongoArtistsCollection == "" {
+			mongoArtistsCollection = "artists"
+		}
+		platform.ServiceLog.Infof("MONGO_DATABASE = %v", mongoDatabase)
+		platform.ServiceLog.Infof("MONGO_COLLECTION = %v", mongoCollection)
+		platform.ServiceLog.Infof("MONGO_ARTISTS_COLLECTION = %v", mongoArtistsCollection)
+
+		// connect and make sure Cosmos can be reached before taking requests
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoConnString).SetMonitor(otelmongo.NewMonitor()))
+		if err != nil {
+			platform.ServiceLog.Fatalf("unable to initialize Cosmos connection - %v", err)
+		}
+		if err = client.Ping(ctx, nil); err != nil {
+			platform.ServiceLog.Fatalf("unable to connect to Cosmos - %v", err)
+		}
+		cancel()
+		defer client.Disconnect(context.Background())
+		platform.ServiceLog.Infof("successfully connected to Cosmos.")
+		mongoContracts := newMongoStore(client.Database(mongoDatabase).Collection(mongoCollection))
+		artistStore = newMongoArtistStore(client.Database(mongoDatabase).Collection(mongoArtistsCollection))
+
+		// a new collection starts with the same contracts as memory does
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+		seeded, err := mongoContracts.seed(ctx, contracts)
+		if err != nil {
+			platform.ServiceLog.Fatalf("unable to seed the contracts collection - %v", err)
+		}
+		cancel()
+		if seeded > 0 {
+			platform.ServiceLog.Infof("seeded the contracts collection with %v artists.", seeded)
+		}
+		contractStore = mongoContracts
+	default:
+		platform.ServiceLog.Fatalf("STORE_BACKEND must be either mongo or memory, not %v.", storeBackend)
+	}
+	platform.ServiceLog.Infof("storing contracts in %v...", storeBackend)
+
+	mux := newHandler(contractStore, artistStore)
 	port, err := strconv.Atoi(os.Getenv("PORT"))
 	if err != nil {
 		port = 80
 	}
-	log.Printf("listening on port %v...\n", port)
-	err = http.ListenAndServe(fmt.Sprint(":", port), nil)
-	log.Fatal(err)
+
+	// requests are limited to the time the caller has left and, optionally,
+	// to REQUEST_TIMEOUT_MS
+	timeoutMs, _ := strconv.Atoi(os.Getenv("REQUEST_TIMEOUT_MS"))
+	platform.ServiceLog.Infof("listening on port %v...", port)
+	handler := platform.WithDeadline(time.Duration(timeoutMs)*time.Millisecond, mux)
+	err = http.ListenAndServe(fmt.Sprint(":", port), platform.Traced("contracts", platform.WithRequestId(platform.Measured(mux, "", handler))))
+	platform.ServiceLog.Fatalf("%v", err)
 }
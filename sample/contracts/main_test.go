@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMain(m *testing.M) {
+	platform.LogOutput = io.Discard
+	os.Exit(m.Run())
+}
+
+// newTestHandler returns a handler backed by empty memory stores.
+func newTestHandler() *http.ServeMux {
+	return newHandler(newMemoryStore(nil), newMemoryArtistStore())
+}
+
+// do sends a request to the handler and returns the response.
+func do(t *testing.T, handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// decode reads the JSON body of the response into val.
+func decode(t *testing.T, w *httptest.ResponseRecorder, val interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), val); err != nil {
+		t.Fatalf("the response could not be decoded - %v: %v", err, w.Body.String())
+	}
+}
+
+func TestStoreContract(t *testing.T) {
+	handler := newTestHandler()
+	w := do(t, handler, "POST", "/", `{"artist": "Eminem", "payment": 0.3, "effectiveFrom": "2020-01-01T00:00:00Z"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %v: %v", w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); location != "/?artist=Eminem&at=2020-01-01T00%3A00%3A00Z" {
+		t.Fatalf("expected the Location of the new contract, got %v", location)
+	}
+
+	w = do(t, handler, "GET", "/?artist=eminem", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	var found contract
+	decode(t, w, &found)
+	if found.Payment != 0.3 || found.Source != sourceContract || found.Default {
+		t.Fatalf("expected the stored contract, got %+v", found)
+	}
+}
+
+func TestStoreContractValidation(t *testing.T) {
+	bodies := map[string]string{
+		"not a contract":        `"Eminem"`,
+		"no artist":             `{"artist": " ", "payment": 0.3}`,
+		"payment out of range":  `{"artist": "Eminem", "payment": 1.5}`,
+		"negative payment":      `{"artist": "Eminem", "payment": -0.1}`,
+		"ends before it starts": `{"artist": "Eminem", "payment": 0.3, "effectiveFrom": "2020-01-01T00:00:00Z", "effectiveTo": "2019-01-01T00:00:00Z"}`,
+		"first tier not from 0": `{"artist": "Eminem", "tiers": [{"from": 10, "payment": 0.3}]}`,
+		"tiers out of order":    `{"artist": "Eminem", "tiers": [{"from": 0, "payment": 0.3}, {"from": 0, "payment": 0.2}]}`,
+		"shares not adding up":  `{"artist": "Eminem", "payment": 0.3, "splits": [{"party": "Eminem", "share": 0.5}, {"party": "Dr. Dre", "share": 0.4}]}`,
+		"party split twice":     `{"artist": "Eminem", "payment": 0.3, "splits": [{"party": "Eminem", "share": 0.5}, {"party": "EMINEM", "share": 0.5}]}`,
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			handler := newTestHandler()
+			if w := do(t, handler, "POST", "/", body); w.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %v: %v", w.Code, w.Body.String())
+			}
+			if w := do(t, handler, "GET", "/history?artist=Eminem", ""); w.Body.String() != "[]" {
+				t.Fatalf("expected nothing to be stored, got %v", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStoreContractOverlap(t *testing.T) {
+	handler := newTestHandler()
+	if w := do(t, handler, "POST", "/", `{"artist": "Eminem", "payment": 0.3, "effectiveFrom": "2020-01-01T00:00:00Z"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %v: %v", w.Code, w.Body.String())
+	}
+	for _, from := range []string{"2019-01-01T00:00:00Z", "2020-01-01T00:00:00Z"} {
+		w := do(t, handler, "POST", "/", fmt.Sprintf(`{"artist": "EMINEM", "payment": 0.4, "effectiveFrom": %q}`, from))
+		if w.Code != http.StatusConflict {
+			t.Fatalf("expected 409 for a contract from %v, got %v: %v", from, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestUpdateContract(t *testing.T) {
+	handler := newTestHandler()
+	if w := do(t, handler, "PUT", "/?artist=Eminem", `{"payment": 0.4}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 updating an artist without a contract, got %v: %v", w.Code, w.Body.String())
+	}
+	do(t, handler, "POST", "/", `{"artist": "Eminem", "payment": 0.3, "effectiveFrom": "2020-01-01T00:00:00Z"}`)
+
+	invalid := map[string]string{
+		"another artist":      `{"artist": "Dr. Dre", "payment": 0.4}`,
+		"when it applies":     `{"payment": 0.4, "effectiveFrom": "2021-01-01T00:00:00Z"}`,
+		"no payment":          `{}`,
+		"out of range":        `{"payment": 2}`,
+		"not a contract":      `[]`,
+		"shares not adding":   `{"payment": 0.4, "splits": [{"party": "Eminem", "share": 0.6}]}`,
+		"first tier not at 0": `{"tiers": [{"from": 5, "payment": 0.4}]}`,
+	}
+	for name, body := range invalid {
+		if w := do(t, handler, "PUT", "/?artist=Eminem", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %v, got %v: %v", name, w.Code, w.Body.String())
+		}
+	}
+	if w := do(t, handler, "PUT", "/?artist=Eminem&at=2019-06-01T00:00:00Z", `{"payment": 0.4}`); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 updating before the contract took effect, got %v", w.Code)
+	}
+
+	// the artist can be corrected in case and the payment changed
+	w := do(t, handler, "PUT", "/?artist=Eminem", `{"artist": "EMINEM", "payment": 0.4}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	var updated contract
+	decode(t, w, &updated)
+	if updated.Artist != "EMINEM" || updated.Payment != 0.4 || !updated.EffectiveFrom.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the corrected contract from when it took effect, got %+v", updated)
+	}
+}
+
+func TestRemoveContract(t *testing.T) {
+	handler := newTestHandler()
+	if w := do(t, handler, "DELETE", "/", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without an artist, got %v", w.Code)
+	}
+	if w := do(t, handler, "DELETE", "/?artist=Eminem", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an artist without a contract, got %v", w.Code)
+	}
+	do(t, handler, "POST", "/", `{"artist": "Eminem", "payment": 0.3, "effectiveFrom": "2020-01-01T00:00:00Z"}`)
+	if w := do(t, handler, "DELETE", "/?artist=Eminem&at=not-a-time", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad time, got %v", w.Code)
+	}
+	if w := do(t, handler, "DELETE", "/?artist=Eminem", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %v: %v", w.Code, w.Body.String())
+	}
+
+	// the artist is paid the default from then on
+	var found contract
+	decode(t, do(t, handler, "GET", "/?artist=Eminem", ""), &found)
+	if !found.Default {
+		t.Fatalf("expected the default contract once the contract ended, got %+v", found)
+	}
+	if w := do(t, handler, "DELETE", "/?artist=Eminem", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 ending a contract that has ended, got %v", w.Code)
+	}
+}
+
+func TestContractHistory(t *testing.T) {
+	handler := newTestHandler()
+	do(t, handler, "POST", "/", `{"artist": "Eminem", "payment": 0.3, "effectiveFrom": "2020-01-01T00:00:00Z"}`)
+	do(t, handler, "POST", "/", `{"artist": "Eminem", "payment": 0.4, "effectiveFrom": "2022-01-01T00:00:00Z"}`)
+
+	// the second contract ends the first when it takes effect
+	var history []contract
+	decode(t, do(t, handler, "GET", "/history?artist=Eminem", ""), &history)
+	if len(history) != 2 || !history[0].EffectiveTo.Equal(*history[1].EffectiveFrom) || history[1].EffectiveTo != nil {
+		t.Fatalf("expected the first contract to end when the second took effect, got %+v", history)
+	}
+
+	// each moment is paid by the contract in force then
+	payments := map[string]float64{
+		"2020-01-01T00:00:00Z":           0.3,
+		"2021-12-31T23:59:59.999Z":       0.3,
+		"2022-01-01T00:00:00Z":           0.4,
+		"2022-01-01T02:00:00%2B01:00":    0.4,
+		"2021-12-31T23:00:00-01:00":      0.4,
+		"2030-06-01T00:00:00.123456789Z": 0.4,
+	}
+	for at, payment := range payments {
+		var found contract
+		decode(t, do(t, handler, "GET", "/?artist=Eminem&at="+at, ""), &found)
+		if found.Payment != payment || found.Default {
+			t.Fatalf("expected %v to be paid %v, got %+v", at, payment, found)
+		}
+	}
+
+	// before the first contract the artist is paid the default
+	var found contract
+	decode(t, do(t, handler, "GET", "/?artist=Eminem&at=2019-12-31T23:59:59Z", ""), &found)
+	if !found.Default {
+		t.Fatalf("expected the default before the first contract, got %+v", found)
+	}
+	if w := do(t, handler, "GET", "/?artist=Eminem&at=yesterday", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad time, got %v", w.Code)
+	}
+}
+
+func TestRemoveScheduledContract(t *testing.T) {
+	handler := newTestHandler()
+	do(t, handler, "POST", "/", `{"artist": "Eminem", "payment": 0.3, "effectiveFrom": "2020-01-01T00:00:00Z"}`)
+	do(t, handler, "POST", "/", `{"artist": "Eminem", "payment": 0.4, "effectiveFrom": "2999-01-01T00:00:00Z"}`)
+
+	// the contract in force can't be ended while a later one is scheduled
+	if w := do(t, handler, "DELETE", "/?artist=Eminem", ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %v: %v", w.Code, w.Body.String())
+	}
+	var history []contract
+	decode(t, do(t, handler, "GET", "/history?artist=Eminem", ""), &history)
+	if len(history) != 2 {
+		t.Fatalf("expected the scheduled contract to be kept, got %+v", history)
+	}
+
+	// ending the scheduled contract when it takes effect removes it, and
+	// then the one in force can be ended
+	if w := do(t, handler, "DELETE", "/?artist=Eminem&at=2999-01-01T00:00:00Z", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 ending the scheduled contract, got %v: %v", w.Code, w.Body.String())
+	}
+	if w := do(t, handler, "DELETE", "/?artist=Eminem", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 ending the contract in force, got %v: %v", w.Code, w.Body.String())
+	}
+	history = nil
+	decode(t, do(t, handler, "GET", "/history?artist=Eminem", ""), &history)
+	if len(history) != 1 || history[0].EffectiveTo == nil || history[0].EffectiveTo.After(time.Now()) {
+		t.Fatalf("expected only the ended contract to be left, got %+v", history)
+	}
+}
+
+func TestLoadDefaultPolicy(t *testing.T) {
+	t.Setenv("DEFAULT_CONTRACT_POLICY", "genre")
+	t.Setenv("DEFAULT_PAYMENT", "0.07")
+	t.Setenv("GENRE_PAYMENTS", " Pop = 0.06, rap=0.04,")
+	loaded, err := loadDefaultPolicy()
+	if err != nil {
+		t.Fatalf("expected the policy to load, got %v", err)
+	}
+	if loaded.name != "genre" || loaded.payment != 0.07 || loaded.genres["pop"] != 0.06 || loaded.genres["rap"] != 0.04 || len(loaded.genres) != 2 {
+		t.Fatalf("expected the genre policy with its rates, got %+v", loaded)
+	}
+
+	invalid := map[string][3]string{
+		"unknown policy":      {"lenient", "", ""},
+		"payment not a rate":  {"rate", "five", ""},
+		"payment over 1":      {"rate", "1.5", ""},
+		"genre without rate":  {"genre", "", "Pop"},
+		"genre rate negative": {"genre", "", "Pop=-0.1"},
+	}
+	for name, env := range invalid {
+		t.Setenv("DEFAULT_CONTRACT_POLICY", env[0])
+		t.Setenv("DEFAULT_PAYMENT", env[1])
+		t.Setenv("GENRE_PAYMENTS", env[2])
+		if _, err := loadDefaultPolicy(); err == nil {
+			t.Fatalf("expected an error for %v", name)
+		}
+	}
+}
+
+func TestDefaultPolicies(t *testing.T) {
+	defer func(p defaultPolicy) { policy = p }(policy)
+	genres := map[string]float64{"pop": 0.06}
+	tests := []struct {
+		policy defaultPolicy
+		pop    *contract
+		rap    *contract
+	}{
+		{
+			policy: defaultPolicy{name: "rate", payment: 0.05, genres: genres},
+			pop:    &contract{Artist: "Tyga", Payment: 0.05, Default: true, Source: sourceDefault},
+			rap:    &contract{Artist: "Tyga", Payment: 0.05, Default: true, Source: sourceDefault},
+		},
+		{
+			policy: defaultPolicy{name: "genre", payment: 0.05, genres: genres},
+			pop:    &contract{Artist: "Tyga", Payment: 0.06, Default: true, Source: sourceGenre},
+			rap:    &contract{Artist: "Tyga", Payment: 0.05, Default: true, Source: sourceDefault},
+		},
+		{
+			policy: defaultPolicy{name: "strict", payment: 0.05, genres: genres},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.name, func(t *testing.T) {
+			policy = test.policy
+			handler := newTestHandler()
+			do(t, handler, "POST", "/", `{"artist": "Drake", "payment": 0.2, "effectiveFrom": "2020-01-01T00:00:00Z"}`)
+
+			// lookups are answered in order, with null for no contract
+			w := do(t, handler, "POST", "/batch", `{"lookups": [{"artist": "Drake", "genre": "Pop"}, {"artist": "Tyga", "genre": " POP "}, {"artist": "Tyga", "genre": "Rap"}]}`)
+			var found []*contract
+			decode(t, w, &found)
+			if len(found) != 3 || found[0] == nil || found[0].Payment != 0.2 || found[0].Source != sourceContract || found[0].Default {
+				t.Fatalf("expected Drake's own contract whatever the policy, got %+v", found)
+			}
+			for i, expected := range []*contract{test.pop, test.rap} {
+				got := found[i+1]
+				if (got == nil) != (expected == nil) || (expected != nil && (got.Payment != expected.Payment || got.Source != expected.Source || !got.Default)) {
+					t.Fatalf("expected lookup %v to be %+v, got %+v", i+1, expected, got)
+				}
+			}
+
+			// without a contract an artist is only found when there is a default
+			w = do(t, handler, "GET", "/?artist=Tyga&genre=Pop", "")
+			if (w.Code == http.StatusOK) != (test.pop != nil) {
+				t.Fatalf("expected the default for Tyga to be found only if there is one, got %v", w.Code)
+			}
+			var artists map[string]contract
+			decode(t, do(t, handler, "GET", "/batch?artist=Drake&artist=Tyga", ""), &artists)
+			if _, ok := artists["Tyga"]; ok != (test.pop != nil) {
+				t.Fatalf("expected Tyga to be left out only under strict, got %+v", artists)
+			}
+		})
+	}
+}
+
+func TestComputePayoutTiers(t *testing.T) {
+	val := contract{Artist: "Drake", Tiers: []tier{{0, 0.01}, {100, 0.02}, {1000, 0.03}}}
+	tests := []struct {
+		plays  int64
+		amount float64
+		bands  []int64
+	}{
+		{0, 0, []int64{}},
+		{1, 0.01, []int64{1}},
+		{100, 1, []int64{100}},
+		{101, 1.02, []int64{100, 1}},
+		{1000, 19, []int64{100, 900}},
+		{1001, 19.03, []int64{100, 900, 1}},
+		{1500, 34, []int64{100, 900, 500}},
+	}
+	for _, test := range tests {
+		result := computePayout(val, test.plays)
+		if result.Amount != test.amount || len(result.Bands) != len(test.bands) {
+			t.Fatalf("expected %v plays to pay %v in %v bands, got %+v", test.plays, test.amount, len(test.bands), result)
+		}
+		for i, plays := range test.bands {
+			if result.Bands[i].Plays != plays {
+				t.Fatalf("expected %v plays in band %v of %v, got %+v", plays, i, test.plays, result.Bands)
+			}
+		}
+		if n := len(result.Bands); n > 0 && n < len(val.Tiers) && *result.Bands[n-1].To != val.Tiers[n].From {
+			t.Fatalf("expected band %v to end where the next tier starts, got %+v", n-1, result.Bands[n-1])
+		}
+		if n := len(result.Bands); n == len(val.Tiers) && result.Bands[n-1].To != nil {
+			t.Fatalf("expected the last tier to be open, got %+v", result.Bands[n-1])
+		}
+	}
+
+	// a contract without tiers pays its payment for every play
+	if result := computePayout(contract{Artist: "Drake", Payment: 0.2}, 7); result.Amount != 1.4 || len(result.Bands) != 1 {
+		t.Fatalf("expected 7 plays at 0.2 to pay 1.4, got %+v", result)
+	}
+}
+
+func TestComputePayoutSplits(t *testing.T) {
+	third := 1.0 / 3
+	val := contract{Artist: "Trio", Payment: 0.01, Splits: []split{{"One", third}, {"Two", third}, {"Three", third}}}
+	result := computePayout(val, 100)
+	if len(result.Shares) != 3 || result.Shares[0].Amount != 0.333333 || result.Shares[1].Amount != 0.333333 || result.Shares[2].Amount != 0.333334 {
+		t.Fatalf("expected the last party to be paid what rounding left, got %+v", result.Shares)
+	}
+	for _, plays := range []int64{1, 7, 99, 12345} {
+		result := computePayout(val, plays)
+		paid := 0.0
+		for _, s := range result.Shares {
+			paid += s.Amount
+		}
+		if roundAmount(paid) != result.Amount {
+			t.Fatalf("expected the shares of %v plays to add up to %v, got %v", plays, result.Amount, paid)
+		}
+	}
+
+	// a contract without splits pays it all to the artist
+	result = computePayout(contract{Artist: "Drake", Payment: 0.2}, 10)
+	if len(result.Shares) != 1 || result.Shares[0].Party != "Drake" || result.Shares[0].Amount != 2 {
+		t.Fatalf("expected all of it to go to Drake, got %+v", result.Shares)
+	}
+}
+
+func TestPayout(t *testing.T) {
+	defer func(p defaultPolicy) { policy = p }(policy)
+	policy = defaultPolicy{name: "rate", payment: 0.05}
+	handler := newTestHandler()
+	do(t, handler, "POST", "/", `{"artist": "Khalid & Normani", "tiers": [{"from": 0, "payment": 0.01}, {"from": 100, "payment": 0.02}], "splits": [{"party": "Khalid", "share": 0.5}, {"party": "Normani", "share": 0.5}], "effectiveFrom": "2020-01-01T00:00:00Z"}`)
+
+	w := do(t, handler, "GET", "/payout?artist=khalid+and+normani&plays=150", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	var result payout
+	decode(t, w, &result)
+	if result.Amount != 2 || len(result.Bands) != 2 || len(result.Shares) != 2 || result.Shares[1].Amount != 1 {
+		t.Fatalf("expected 150 plays to pay 2 split in half, got %+v", result)
+	}
+
+	// before the contract the default rate is paid
+	decode(t, do(t, handler, "GET", "/payout?artist=Khalid+%26+Normani&plays=150&at=2019-01-01T00:00:00Z", ""), &result)
+	if result.Amount != 7.5 || !result.Contract.Default {
+		t.Fatalf("expected 150 plays at the default rate, got %+v", result)
+	}
+
+	invalid := []string{"/payout?plays=150", "/payout?artist=Drake", "/payout?artist=Drake&plays=-1", "/payout?artist=Drake&plays=many", "/payout?artist=Drake&plays=1&at=soon"}
+	for _, target := range invalid {
+		if w := do(t, handler, "GET", target, ""); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %v, got %v", target, w.Code)
+		}
+	}
+
+	// under a strict policy an artist without a contract isn't paid
+	policy = defaultPolicy{name: "strict"}
+	if w := do(t, handler, "GET", "/payout?artist=Drake&plays=1", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 under a strict policy, got %v", w.Code)
+	}
+}
+
+func TestHistoryRequiresArtist(t *testing.T) {
+	if w := do(t, newTestHandler(), "GET", "/history", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %v", w.Code)
+	}
+}
+
+func TestMethodNotImplemented(t *testing.T) {
+	if w := do(t, newTestHandler(), "PATCH", "/?artist=Eminem", ""); w.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %v", w.Code)
+	}
+}
+
+// mongoTestDatabase connects to the Mongo at MONGO_TEST_CONNSTRING, or
+// returns nil if it isn't set.
+func mongoTestDatabase(t *testing.T) *mongo.Database {
+	connString := os.Getenv("MONGO_TEST_CONNSTRING")
+	if connString == "" {
+		return nil
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connString))
+	if err != nil {
+		t.Fatalf("unable to connect to Mongo - %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(ctx) })
+	return client.Database("test")
+}
+
+// mongoTestCollection returns a new collection that is dropped after the test.
+func mongoTestCollection(t *testing.T, db *mongo.Database, name string) *mongo.Collection {
+	collection := db.Collection(fmt.Sprint(name, "-", time.Now().UnixNano()))
+	t.Cleanup(func() { collection.Drop(context.Background()) })
+	return collection
+}
+
+// contractStores returns the stores to test, each empty: memory, and Mongo
+// too when MONGO_TEST_CONNSTRING is set.
+func contractStores(t *testing.T) map[string]func() ContractStore {
+	stores := map[string]func() ContractStore{
+		"memory": func() ContractStore { return newMemoryStore(nil) },
+	}
+	if db := mongoTestDatabase(t); db != nil {
+		stores["mongo"] = func() ContractStore { return newMongoStore(mongoTestCollection(t, db, "contracts")) }
+	}
+	return stores
+}
+
+func TestContractStore(t *testing.T) {
+	ctx := context.Background()
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, newStore := range contractStores(t) {
+		t.Run(name, func(t *testing.T) {
+			contractStore := newStore()
+			err := contractStore.Change(ctx, "Beyoncé", func(history []contract) ([]contract, error) {
+				return addContract(history, contract{Artist: "Beyoncé", Payment: 0.3, EffectiveFrom: &from})
+			})
+			if err != nil {
+				t.Fatalf("the contract could not be stored - %v", err)
+			}
+
+			// artists are matched however their name is written
+			history, err := contractStore.History(ctx, "BEYONCE")
+			if err != nil || len(history) != 1 || history[0].Payment != 0.3 {
+				t.Fatalf("expected the contract by another spelling, got %+v %v", history, err)
+			}
+			histories, err := contractStore.HistoryMany(ctx, []string{"beyonce", "Drake"})
+			if err != nil || len(histories) != 1 || len(histories["beyonce"]) != 1 {
+				t.Fatalf("expected only the artist with a contract, keyed as asked, got %+v %v", histories, err)
+			}
+
+			// a change that fails stores nothing
+			failed := errors.New("failed")
+			err = contractStore.Change(ctx, "Beyoncé", func(history []contract) ([]contract, error) {
+				return nil, failed
+			})
+			if err != failed {
+				t.Fatalf("expected the change's error, got %v", err)
+			}
+			if history, _ := contractStore.History(ctx, "Beyoncé"); len(history) != 1 {
+				t.Fatalf("expected the history to be unchanged, got %+v", history)
+			}
+
+			// an overlapping contract is refused by the change
+			err = contractStore.Change(ctx, "Beyoncé", func(history []contract) ([]contract, error) {
+				return addContract(history, contract{Artist: "Beyoncé", Payment: 0.4, EffectiveFrom: &from})
+			})
+			if err != ErrOverlap {
+				t.Fatalf("expected ErrOverlap, got %v", err)
+			}
+		})
+	}
+}
+
+func TestArtistKey(t *testing.T) {
+	same := [][2]string{
+		{"Beyoncé", "BEYONCE"},
+		{"Khalid & Normani", "khalid and  normani"},
+		{"  AC/DC ", "ac dc"},
+		{"Jay-Z", "jay z"},
+		{"will_i_am", "Will I Am"},
+		{"Ｄｒａｋｅ", "drake"},
+		{"Motörhead", "Motorhead"},
+		{"Guns N' Roses", "guns n roses"},
+	}
+	for _, names := range same {
+		if artistKey(names[0]) != artistKey(names[1]) {
+			t.Fatalf("expected %q and %q to be the same artist, got %q and %q", names[0], names[1], artistKey(names[0]), artistKey(names[1]))
+		}
+	}
+
+	// marks that change letters other than Latin ones are kept
+	if artistKey("ヴィジュアル") == artistKey("ウィシュアル") {
+		t.Fatal("expected the dakuten to be kept")
+	}
+	if key := artistKey("ヴィジュアル"); key != "ヴィジュアル" {
+		t.Fatalf("expected the name to be recomposed, got %q", key)
+	}
+	if artistKey("Drake") == artistKey("Drakes") || artistKey(" & ") != "and" || artistKey("!?") != "" {
+		t.Fatal("expected only differences in writing to be ignored")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	handler := newTestHandler()
+	w := do(t, handler, "POST", "/artists/aliases", `{"artist": "Prince", "alias": "The Artist"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %v: %v", w.Code, w.Body.String())
+	}
+
+	// a contract made under the alias is the artist's
+	w = do(t, handler, "POST", "/", `{"artist": "the artist", "payment": 0.3, "effectiveFrom": "2020-01-01T00:00:00Z"}`)
+	var stored contract
+	decode(t, w, &stored)
+	if w.Code != http.StatusCreated || stored.Artist != "Prince" {
+		t.Fatalf("expected the contract to be stored under Prince, got %v: %+v", w.Code, stored)
+	}
+	for _, name := range []string{"Prince", "PRINCE", "The Artist", "the  artist"} {
+		var found contract
+		decode(t, do(t, handler, "GET", "/?artist="+url.QueryEscape(name), ""), &found)
+		if found.Payment != 0.3 || found.Default {
+			t.Fatalf("expected Prince's contract by %q, got %+v", name, found)
+		}
+	}
+	var artists map[string]contract
+	decode(t, do(t, handler, "GET", "/batch?artist=Prince&artist=The+Artist", ""), &artists)
+	if artists["Prince"].Payment != 0.3 || artists["The Artist"].Payment != 0.3 {
+		t.Fatalf("expected the contract under both names as asked, got %+v", artists)
+	}
+	var record artistRecord
+	decode(t, do(t, handler, "GET", "/artists?artist=the+artist", ""), &record)
+	if record.Name != "Prince" || len(record.Aliases) != 1 || record.Aliases[0] != "The Artist" {
+		t.Fatalf("expected Prince with their alias, got %+v", record)
+	}
+
+	// the artist can be corrected by their canonical name only
+	if w := do(t, handler, "PUT", "/?artist=The+Artist", `{"artist": "The Artist", "payment": 0.4}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 renaming the contract to the alias, got %v", w.Code)
+	}
+	if w := do(t, handler, "PUT", "/?artist=The+Artist", `{"artist": "PRINCE", "payment": 0.4}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 correcting the canonical name, got %v: %v", w.Code, w.Body.String())
+	}
+
+	// names that are taken or have contracts can't become aliases
+	do(t, handler, "POST", "/", `{"artist": "Drake", "payment": 0.2}`)
+	if w := do(t, handler, "POST", "/artists/aliases", `{"artist": "Prince", "alias": "Drake"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a name with contracts, got %v", w.Code)
+	}
+	if w := do(t, handler, "POST", "/artists/aliases", `{"artist": "Drake", "alias": "the artist"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for another artist's alias, got %v", w.Code)
+	}
+	if w := do(t, handler, "POST", "/artists/aliases", `{"artist": "Drake", "alias": "Prince"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for an artist with aliases, got %v", w.Code)
+	}
+	decode(t, do(t, handler, "GET", "/artists?artist=Drake", ""), &record)
+	if record.Name != "Drake" || len(record.Aliases) != 0 {
+		t.Fatalf("expected Drake to be left without aliases, got %+v", record)
+	}
+
+	// once the alias is removed it is its own artist again
+	if w := do(t, handler, "DELETE", "/artists/aliases?alias=The+Artist", ""); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", w.Code)
+	}
+	if w := do(t, handler, "DELETE", "/artists/aliases?alias=The+Artist", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 removing a name that isn't an alias, got %v", w.Code)
+	}
+	var found contract
+	decode(t, do(t, handler, "GET", "/?artist=The+Artist", ""), &found)
+	if !found.Default {
+		t.Fatalf("expected the former alias to have no contract, got %+v", found)
+	}
+}
+
+func TestAddAliasWhileStoring(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		handler := newTestHandler()
+		var wg sync.WaitGroup
+		var aliasStatus int
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			aliasStatus = do(t, handler, "POST", "/artists/aliases", `{"artist": "Prince", "alias": "The Artist"}`).Code
+		}()
+		go func() {
+			defer wg.Done()
+			do(t, handler, "POST", "/", `{"artist": "The Artist", "payment": 0.3}`)
+		}()
+		wg.Wait()
+
+		// either the alias was added first and the contract is Prince's, or
+		// the contract was and the alias was refused
+		var history []contract
+		decode(t, do(t, handler, "GET", "/history?artist=Prince", ""), &history)
+		switch aliasStatus {
+		case http.StatusCreated:
+			if len(history) != 1 || history[0].Artist != "Prince" {
+				t.Fatalf("expected the contract to be Prince's once the alias was added, got %+v", history)
+			}
+		case http.StatusConflict:
+			if len(history) != 0 {
+				t.Fatalf("expected the contract to stay with the name when the alias was refused, got %+v", history)
+			}
+		default:
+			t.Fatalf("expected the alias to be added or refused, got %v", aliasStatus)
+		}
+	}
+}
+
+func TestMongoSeed(t *testing.T) {
+	db := mongoTestDatabase(t)
+	if db == nil {
+		t.Skip("MONGO_TEST_CONNSTRING is not set")
+	}
+	ctx := context.Background()
+	store := newMongoStore(mongoTestCollection(t, db, "contracts"))
+
+	// an empty collection is given the seed contracts
+	seeded, err := store.seed(ctx, contracts)
+	if err != nil || seeded != len(contracts) {
+		t.Fatalf("expected %v artists to be seeded, got %v - %v", len(contracts), seeded, err)
+	}
+	history, err := store.History(ctx, "khalid and normani")
+	if err != nil || len(history) != 1 || len(history[0].Splits) != 2 {
+		t.Fatalf("expected the seeded contract, got %+v %v", history, err)
+	}
+
+	// once it has contracts it is left alone
+	seeded, err = store.seed(ctx, []contract{{Artist: "Tyga", Payment: 0.1}})
+	if err != nil || seeded != 0 {
+		t.Fatalf("expected nothing to be seeded, got %v - %v", seeded, err)
+	}
+	if history, _ := store.History(ctx, "Tyga"); len(history) != 0 {
+		t.Fatalf("expected Tyga not to be stored, got %+v", history)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// memoryStore keeps contracts in a map; it is meant for local development
+// where there is no Cosmos instance.
+type memoryStore struct {
+	mutex     sync.RWMutex
+	histories map[string][]contract
+}
+
+func newMemoryStore(seed []contract) *memoryStore {
+	store := &memoryStore{histories: map[string][]contract{}}
+	for _, val := range seed {
+		key := artistKey(val.Artist)
+		store.histories[key] = append(store.histories[key], val)
+	}
+	return store
+}
+
+func (s *memoryStore) History(ctx context.Context, artist string) ([]contract, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]contract{}, s.histories[artistKey(artist)]...), nil
+}
+
+func (s *memoryStore) HistoryMany(ctx context.Context, artists []string) (map[string][]contract, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	found := map[string][]contract{}
+	for _, artist := range artists {
+		if history, ok := s.histories[artistKey(artist)]; ok {
+			found[artist] = append([]contract{}, history...)
+		}
+	}
+	return found, nil
+}
+
+func (s *memoryStore) Change(ctx context.Context, artist string, change func(history []contract) ([]contract, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := artistKey(artist)
+	history, err := change(append([]contract{}, s.histories[key]...))
+	if err != nil {
+		return err
+	}
+	s.histories[key] = history
+	return nil
+}
+
+// memoryArtistStore keeps aliases in a map, keyed like aliases in Mongo.
+type memoryArtistStore struct {
+	mutex   sync.RWMutex
+	aliases map[string]alias
+}
+
+func newMemoryArtistStore() *memoryArtistStore {
+	return &memoryArtistStore{aliases: map[string]alias{}}
+}
+
+// resolve returns the canonical name and key of the artist.
+func (s *memoryArtistStore) resolve(artist string) (string, string) {
+	key := artistKey(artist)
+	if a, ok := s.aliases[key]; ok {
+		return a.Artist, a.ArtistKey
+	}
+	for _, a := range s.aliases {
+		if a.ArtistKey == key {
+			return a.Artist, key
+		}
+	}
+	return artist, key
+}
+
+func (s *memoryArtistStore) record(artist, key string) artistRecord {
+	aliases := []alias{}
+	for _, a := range s.aliases {
+		if a.ArtistKey == key {
+			aliases = append(aliases, a)
+		}
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Key < aliases[j].Key })
+	return newArtistRecord(artist, aliases)
+}
+
+func (s *memoryArtistStore) Canonical(ctx context.Context, artists []string) (map[string]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	names := make(map[string]string, len(artists))
+	for _, artist := range artists {
+		names[artist], _ = s.resolve(artist)
+	}
+	return names, nil
+}
+
+func (s *memoryArtistStore) Artist(ctx context.Context, name string) (artistRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.record(s.resolve(name)), nil
+}
+
+func (s *memoryArtistStore) AddAlias(ctx context.Context, artist, name string) (artistRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	artist, key := s.resolve(artist)
+	aliasKey := artistKey(name)
+	if aliasKey == key {
+		return s.record(artist, key), nil
+	}
+	if a, ok := s.aliases[aliasKey]; ok {
+		if a.ArtistKey != key {
+			return artistRecord{}, ErrAliasTaken
+		}
+		return s.record(artist, key), nil
+	}
+	// an artist with aliases of their own can't become an alias
+	if len(s.record(name, aliasKey).Aliases) > 0 {
+		return artistRecord{}, ErrAliasTaken
+	}
+	s.aliases[aliasKey] = alias{Key: aliasKey, Name: name, Artist: artist, ArtistKey: key}
+	return s.record(artist, key), nil
+}
+
+func (s *memoryArtistStore) RemoveAlias(ctx context.Context, name string) (artistRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	a, ok := s.aliases[artistKey(name)]
+	if !ok {
+		return artistRecord{}, ErrNotAlias
+	}
+	delete(s.aliases, a.Key)
+	return s.record(a.Artist, a.ArtistKey), nil
+}
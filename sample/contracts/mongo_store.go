@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// how many times a change is retried when another one got there first.
+const maxChangeAttempts = 5
+
+var errChangeConflict = errors.New("the contracts were changed by another request")
+
+type mongoStore struct {
+	collection *mongo.Collection
+}
+
+// contractDocument holds an artist's history; the id is the normalised
+// artist and the version guards against concurrent changes.
+type contractDocument struct {
+	Key     string     `bson:"_id"`
+	Version int        `bson:"version"`
+	History []contract `bson:"history"`
+}
+
+func newMongoStore(collection *mongo.Collection) *mongoStore {
+	return &mongoStore{collection: collection}
+}
+
+// seed stores the contracts when the collection is empty, as the memory
+// store starts with them, and returns how many artists were stored. Another
+// replica seeding at the same time may store some of them first.
+func (s *mongoStore) seed(ctx context.Context, contracts []contract) (int, error) {
+	count, err := s.collection.CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1))
+	if err != nil || count > 0 {
+		return 0, err
+	}
+	histories := map[string][]contract{}
+	keys := []string{}
+	for _, val := range contracts {
+		key := artistKey(val.Artist)
+		if _, ok := histories[key]; !ok {
+			keys = append(keys, key)
+		}
+		histories[key] = append(histories[key], val)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	docs := make([]interface{}, len(keys))
+	for i, key := range keys {
+		docs[i] = contractDocument{Key: key, Version: 1, History: histories[key]}
+	}
+	result, err := s.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if mongo.IsDuplicateKeyError(err) {
+		err = nil
+	}
+	if result == nil {
+		return 0, err
+	}
+	return len(result.InsertedIDs), err
+}
+
+func (s *mongoStore) find(ctx context.Context, key string) (contractDocument, error) {
+	doc := contractDocument{Key: key}
+	err := s.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return doc, nil
+	}
+	return doc, err
+}
+
+func (s *mongoStore) History(ctx context.Context, artist string) ([]contract, error) {
+	doc, err := s.find(ctx, artistKey(artist))
+	if err != nil {
+		return nil, err
+	}
+	return doc.History, nil
+}
+
+func (s *mongoStore) HistoryMany(ctx context.Context, artists []string) (map[string][]contract, error) {
+	keys := make([]string, len(artists))
+	for i, artist := range artists {
+		keys[i] = artistKey(artist)
+	}
+	cur, err := s.collection.Find(ctx, bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		return nil, err
+	}
+	var docs []contractDocument
+	if err = cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	// the histories are returned under the artists as they were asked for
+	byKey := make(map[string][]contract, len(docs))
+	for _, doc := range docs {
+		byKey[doc.Key] = doc.History
+	}
+	found := map[string][]contract{}
+	for i, artist := range artists {
+		if history, ok := byKey[keys[i]]; ok {
+			found[artist] = history
+		}
+	}
+	return found, nil
+}
+
+func (s *mongoStore) Change(ctx context.Context, artist string, change func(history []contract) ([]contract, error)) error {
+	key := artistKey(artist)
+	for attempt := 0; attempt < maxChangeAttempts; attempt++ {
+		err := s.change(ctx, key, change)
+		if err != errChangeConflict {
+			return err
+		}
+	}
+	return errChangeConflict
+}
+
+// change makes one attempt at a change, failing with errChangeConflict if
+// the history was changed since it was read.
+func (s *mongoStore) change(ctx context.Context, key string, change func(history []contract) ([]contract, error)) error {
+	doc, err := s.find(ctx, key)
+	if err != nil {
+		return err
+	}
+	history, err := change(doc.History)
+	if err != nil {
+		return err
+	}
+	updated := contractDocument{Key: key, Version: doc.Version + 1, History: history}
+
+	// a new artist is inserted; the unique id catches a concurrent insert
+	if doc.Version == 0 {
+		_, err = s.collection.InsertOne(ctx, updated)
+		if mongo.IsDuplicateKeyError(err) {
+			return errChangeConflict
+		}
+		return err
+	}
+
+	// anyone else's change since it was read moves the version on
+	result, err := s.collection.ReplaceOne(ctx, bson.M{"_id": key, "version": doc.Version}, updated)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errChangeConflict
+	}
+	return nil
+}
+
+// mongoArtistStore keeps each alias in its own document so that the unique
+// id stops a name becoming the alias of two artists.
+type mongoArtistStore struct {
+	collection *mongo.Collection
+}
+
+func newMongoArtistStore(collection *mongo.Collection) *mongoArtistStore {
+	return &mongoArtistStore{collection: collection}
+}
+
+// resolve returns the canonical name and key of the artist.
+func (s *mongoArtistStore) resolve(ctx context.Context, artist string) (string, string, error) {
+	key := artistKey(artist)
+	var a alias
+	err := s.collection.FindOne(ctx, bson.M{"$or": bson.A{bson.M{"_id": key}, bson.M{"artistKey": key}}}).Decode(&a)
+	if err == mongo.ErrNoDocuments {
+		return artist, key, nil
+	} else if err != nil {
+		return "", "", err
+	}
+	return a.Artist, a.ArtistKey, nil
+}
+
+func (s *mongoArtistStore) record(ctx context.Context, artist, key string) (artistRecord, error) {
+	cur, err := s.collection.Find(ctx, bson.M{"artistKey": key}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return artistRecord{}, err
+	}
+	var aliases []alias
+	if err = cur.All(ctx, &aliases); err != nil {
+		return artistRecord{}, err
+	}
+	return newArtistRecord(artist, aliases), nil
+}
+
+func (s *mongoArtistStore) Canonical(ctx context.Context, artists []string) (map[string]string, error) {
+	keys := make([]string, len(artists))
+	for i, artist := range artists {
+		keys[i] = artistKey(artist)
+	}
+	cur, err := s.collection.Find(ctx, bson.M{"$or": bson.A{bson.M{"_id": bson.M{"$in": keys}}, bson.M{"artistKey": bson.M{"$in": keys}}}})
+	if err != nil {
+		return nil, err
+	}
+	var aliases []alias
+	if err = cur.All(ctx, &aliases); err != nil {
+		return nil, err
+	}
+
+	// both aliases and the artists they belong to give the canonical name
+	byKey := make(map[string]string, len(aliases))
+	for _, a := range aliases {
+		byKey[a.Key] = a.Artist
+		byKey[a.ArtistKey] = a.Artist
+	}
+	names := make(map[string]string, len(artists))
+	for i, artist := range artists {
+		names[artist] = artist
+		if name, ok := byKey[keys[i]]; ok {
+			names[artist] = name
+		}
+	}
+	return names, nil
+}
+
+func (s *mongoArtistStore) Artist(ctx context.Context, name string) (artistRecord, error) {
+	artist, key, err := s.resolve(ctx, name)
+	if err != nil {
+		return artistRecord{}, err
+	}
+	return s.record(ctx, artist, key)
+}
+
+func (s *mongoArtistStore) AddAlias(ctx context.Context, artist, name string) (artistRecord, error) {
+	artist, key, err := s.resolve(ctx, artist)
+	if err != nil {
+		return artistRecord{}, err
+	}
+	aliasKey := artistKey(name)
+	if aliasKey == key {
+		return s.record(ctx, artist, key)
+	}
+
+	// an artist with aliases of their own can't become an alias
+	count, err := s.collection.CountDocuments(ctx, bson.M{"artistKey": aliasKey})
+	if err != nil {
+		return artistRecord{}, err
+	}
+	if count > 0 {
+		return artistRecord{}, ErrAliasTaken
+	}
+
+	// the unique id catches a name that is already an alias
+	_, err = s.collection.InsertOne(ctx, alias{Key: aliasKey, Name: name, Artist: artist, ArtistKey: key})
+	if mongo.IsDuplicateKeyError(err) {
+		var existing alias
+		if err = s.collection.FindOne(ctx, bson.M{"_id": aliasKey}).Decode(&existing); err != nil {
+			return artistRecord{}, err
+		}
+		if existing.ArtistKey != key {
+			return artistRecord{}, ErrAliasTaken
+		}
+	} else if err != nil {
+		return artistRecord{}, err
+	}
+	return s.record(ctx, artist, key)
+}
+
+func (s *mongoArtistStore) RemoveAlias(ctx context.Context, name string) (artistRecord, error) {
+	var a alias
+	err := s.collection.FindOneAndDelete(ctx, bson.M{"_id": artistKey(name)}).Decode(&a)
+	if err == mongo.ErrNoDocuments {
+		return artistRecord{}, ErrNotAlias
+	} else if err != nil {
+		return artistRecord{}, err
+	}
+	return s.record(ctx, a.Artist, a.ArtistKey)
+}
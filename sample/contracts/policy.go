@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// where a contract came from, as reported in the source of each lookup.
+const (
+	sourceContract = "contract"
+	sourceDefault  = "default"
+	sourceGenre    = "genre"
+)
+
+// defaultPolicy decides what an artist without a contract is paid: a single
+// rate ("rate"), a rate for the genre of the song ("genre"), or nothing at all
+// ("strict").
+type defaultPolicy struct {
+	name    string
+	payment float64
+	genres  map[string]float64
+}
+
+var policy = defaultPolicy{name: "rate", payment: 0.05}
+
+// loadDefaultPolicy reads the policy from DEFAULT_CONTRACT_POLICY, the rate
+// from DEFAULT_PAYMENT and the genre rates from GENRE_PAYMENTS, for example
+// "Pop=0.06,Rap=0.04". Genres without a rate are paid the default rate.
+func loadDefaultPolicy() (defaultPolicy, error) {
+	loaded := defaultPolicy{name: os.Getenv("DEFAULT_CONTRACT_POLICY"), payment: 0.05, genres: map[string]float64{}}
+	switch loaded.name {
+	case "":
+		loaded.name = "rate"
+	case "rate", "genre", "strict":
+	default:
+		return loaded, fmt.Errorf("DEFAULT_CONTRACT_POLICY must be rate, genre or strict, not %v", loaded.name)
+	}
+	if val := os.Getenv("DEFAULT_PAYMENT"); val != "" {
+		payment, err := strconv.ParseFloat(val, 64)
+		if err != nil || payment < 0 || payment > 1 {
+			return loaded, fmt.Errorf("DEFAULT_PAYMENT must be between 0 and 1, not %v", val)
+		}
+		loaded.payment = payment
+	}
+	for _, pair := range strings.Split(os.Getenv("GENRE_PAYMENTS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return loaded, fmt.Errorf("GENRE_PAYMENTS must be a list of genre=payment, not %v", pair)
+		}
+		payment, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || payment < 0 || payment > 1 {
+			return loaded, fmt.Errorf("the payment for %v must be between 0 and 1, not %v", parts[0], parts[1])
+		}
+		loaded.genres[strings.ToLower(strings.TrimSpace(parts[0]))] = payment
+	}
+	return loaded, nil
+}
+
+// fallback returns what the artist is paid for a song in the genre when they
+// have no contract, or false if the policy is strict.
+func (p defaultPolicy) fallback(artist, genre string) (contract, bool) {
+	switch p.name {
+	case "strict":
+		return contract{}, false
+	case "genre":
+		if payment, ok := p.genres[strings.ToLower(strings.TrimSpace(genre))]; ok {
+			return contract{Artist: artist, Payment: payment, Default: true, Source: sourceGenre}, true
+		}
+	}
+	return contract{Artist: artist, Payment: p.payment, Default: true, Source: sourceDefault}, true
+}
+
+// resolve returns the contract in force at the moment or, failing that, the
+// fallback for the song's genre.
+func (p defaultPolicy) resolve(history []contract, artist, genre string, at time.Time) (contract, bool) {
+	if val, ok := contractAt(history, at); ok {
+		val.Source = sourceContract
+		return val, true
+	}
+	return p.fallback(artist, genre)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrNotFound is returned when the artist has no contract in force.
+var ErrNotFound = errors.New("the artist has no contract")
+
+// ErrOverlap is returned when a contract would take effect before the
+// artist's latest contract; history can only be added to at the end.
+var ErrOverlap = errors.New("the contract would overlap the artist's latest contract")
+
+// ErrScheduled is returned when a contract is ended while others are due to
+// take effect after it.
+var ErrScheduled = errors.New("the artist has contracts that take effect later")
+
+// ContractStore is the storage backend for contracts. Each artist has a
+// history of contracts, ordered by when they take effect, that never overlap.
+// Artists are matched by artistKey.
+type ContractStore interface {
+	// History returns the artist's contracts, or none if they have never had
+	// one.
+	History(ctx context.Context, artist string) ([]contract, error)
+
+	// HistoryMany returns the contracts of each artist that has had one,
+	// keyed by the artist as given.
+	HistoryMany(ctx context.Context, artists []string) (map[string][]contract, error)
+
+	// Change replaces the artist's history with what change makes of it. The
+	// change is atomic; if change returns an error nothing is stored.
+	Change(ctx context.Context, artist string, change func(history []contract) ([]contract, error)) error
+}
+
+// artistKey identifies an artist however their name is written. Case,
+// accents on Latin letters, punctuation and differences in whitespace are
+// ignored and "&" is read as "and", so "Beyoncé" is "beyonce" and
+// "Khalid & Normani" is "khalid and normani".
+func artistKey(artist string) string {
+	var b strings.Builder
+	var last rune
+	for _, r := range norm.NFKD.String(artist) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// marks elsewhere, like the dakuten of kana, change the letter
+			if !unicode.Is(unicode.Latin, last) {
+				b.WriteRune(r)
+			}
+			continue
+		case r == '&':
+			b.WriteString(" and ")
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToLower(r))
+		case unicode.IsSpace(r) || unicode.Is(unicode.Pd, r) || r == '/' || r == '_':
+			b.WriteRune(' ')
+		}
+		last = r
+	}
+	return norm.NFC.String(strings.Join(strings.Fields(b.String()), " "))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// tier is the payment per play for plays from the count onwards, until the
+// next tier starts. Like tax brackets, only the plays within a band are paid
+// at its rate.
+type tier struct {
+	From    int64   `json:"from" bson:"from"`
+	Payment float64 `json:"payment" bson:"payment"`
+}
+
+// split is the share of every payout that goes to one party of a
+// collaboration.
+type split struct {
+	Party string  `json:"party" bson:"party"`
+	Share float64 `json:"share" bson:"share"`
+}
+
+// how far the shares of a split may be from adding up to exactly 1.
+const shareTolerance = 1e-9
+
+// validateTerms returns why the tiers and splits of a contract can't be
+// stored, if they can't.
+func validateTerms(val contract) string {
+	for i, t := range val.Tiers {
+		if i == 0 && t.From != 0 {
+			return "the first tier must start from 0 plays."
+		}
+		if i > 0 && t.From <= val.Tiers[i-1].From {
+			return "each tier must start from more plays than the one before."
+		}
+		if t.Payment < 0 || t.Payment > 1 {
+			return "the payment of each tier must be between 0 and 1."
+		}
+	}
+	total := 0.0
+	parties := map[string]bool{}
+	for _, s := range val.Splits {
+		party := artistKey(s.Party)
+		if party == "" {
+			return "each split must name a party."
+		}
+		if parties[party] {
+			return fmt.Sprintf("%v has more than one split.", strings.TrimSpace(s.Party))
+		}
+		parties[party] = true
+		if s.Share <= 0 || s.Share > 1 {
+			return "the share of each split must be more than 0 and no more than 1."
+		}
+		total += s.Share
+	}
+	if len(val.Splits) > 0 && math.Abs(total-1) > shareTolerance {
+		return fmt.Sprintf("the shares of the splits must add up to 1, not %v.", total)
+	}
+	return ""
+}
+
+// band is what the plays within one tier were paid.
+type band struct {
+	From    int64   `json:"from"`
+	To      *int64  `json:"to,omitempty"`
+	Plays   int64   `json:"plays"`
+	Payment float64 `json:"payment"`
+	Amount  float64 `json:"amount"`
+}
+
+// share is what one party of a split is paid.
+type share struct {
+	Party  string  `json:"party"`
+	Share  float64 `json:"share"`
+	Amount float64 `json:"amount"`
+}
+
+// payout is what a contract pays for a number of plays, by tier and by
+// party.
+type payout struct {
+	Artist   string   `json:"artist"`
+	Plays    int64    `json:"plays"`
+	Amount   float64  `json:"amount"`
+	Bands    []band   `json:"bands"`
+	Shares   []share  `json:"shares"`
+	Contract contract `json:"contract"`
+}
+
+// roundAmount keeps amounts to a millionth so that they add up the way people
+// expect.
+func roundAmount(amount float64) float64 {
+	return math.Round(amount*1e6) / 1e6
+}
+
+// computePayout works out what the contract pays for the plays. A contract
+// without tiers pays its payment for every play, and one without splits pays
+// it all to the artist.
+func computePayout(val contract, plays int64) payout {
+	tiers := val.Tiers
+	if len(tiers) == 0 {
+		tiers = []tier{{From: 0, Payment: val.Payment}}
+	}
+	result := payout{Artist: val.Artist, Plays: plays, Bands: []band{}, Shares: []share{}, Contract: val}
+	for i, t := range tiers {
+		if plays <= t.From {
+			break
+		}
+		b := band{From: t.From, Plays: plays - t.From, Payment: t.Payment}
+		if i+1 < len(tiers) {
+			to := tiers[i+1].From
+			b.To = &to
+			if plays > to {
+				b.Plays = to - t.From
+			}
+		}
+		b.Amount = roundAmount(float64(b.Plays) * t.Payment)
+		result.Amount += b.Amount
+		result.Bands = append(result.Bands, b)
+	}
+	result.Amount = roundAmount(result.Amount)
+
+	splits := val.Splits
+	if len(splits) == 0 {
+		splits = []split{{Party: val.Artist, Share: 1}}
+	}
+	// the last party is paid what is left so that the shares add up to the
+	// amount however they round
+	paid := 0.0
+	for i, s := range splits {
+		amount := roundAmount(result.Amount * s.Share)
+		if i == len(splits)-1 {
+			amount = roundAmount(result.Amount - paid)
+		}
+		paid += amount
+		result.Shares = append(result.Shares, share{Party: s.Party, Share: s.Share, Amount: amount})
+	}
+	return result
+}
@@ -0,0 +1,44 @@
+package platform
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeader carries how many milliseconds are left for a request.
+const TimeoutHeader = "X-Request-Timeout-Ms"
+
+// WithDeadline gives each request a deadline: the budget the caller passed
+// in the header, limited to maxTimeout when it is set. A request that arrives
+// with no time left is refused straight away.
+func WithDeadline(maxTimeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := maxTimeout
+		if ms, err := strconv.Atoi(r.Header.Get(TimeoutHeader)); err == nil {
+			if ms <= 0 {
+				HttpError(w, "the request deadline has passed.", http.StatusGatewayTimeout)
+				return
+			}
+			if budget := time.Duration(ms) * time.Millisecond; timeout <= 0 || budget < timeout {
+				timeout = budget
+			}
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SetTimeoutHeader passes what is left of the request's deadline on to the
+// next service.
+func SetTimeoutHeader(req *http.Request) {
+	if deadline, ok := req.Context().Deadline(); ok {
+		req.Header.Set(TimeoutHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+	}
+}
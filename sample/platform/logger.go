@@ -0,0 +1,185 @@
+// Package platform is what every service in the sample shares, so that they
+// all log and handle requests the same way.
+package platform
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIdHeader identifies a request across the services it passes through.
+const RequestIdHeader = "X-Request-ID"
+
+// logLevel orders how much a log line matters.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{levelDebug: "debug", levelInfo: "info", levelWarn: "warn", levelError: "error"}
+
+var (
+	logMutex    sync.Mutex
+	logService  string
+	logMinLevel = levelInfo
+)
+
+// LogOutput is where log lines are written.
+var LogOutput io.Writer = os.Stderr
+
+// logLine is what is written, one JSON object per line, for each message.
+type logLine struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Service   string `json:"service"`
+	RequestId string `json:"requestId,omitempty"`
+	TraceId   string `json:"traceId,omitempty"`
+	Message   string `json:"msg"`
+}
+
+// Logger writes log lines tagged with the request they are about, if any.
+type Logger struct {
+	requestId string
+	traceId   string
+}
+
+// ServiceLog is for messages that aren't about a request.
+var ServiceLog = &Logger{}
+
+// SetupLogging writes JSON log lines for the service at LOG_LEVEL (debug,
+// info, warn or error; info by default). Anything still logged with the log
+// package, such as by libraries, is written as info.
+func SetupLogging(service string) error {
+	logService = service
+	switch level := strings.ToLower(os.Getenv("LOG_LEVEL")); level {
+	case "debug":
+		logMinLevel = levelDebug
+	case "", "info":
+		logMinLevel = levelInfo
+	case "warn", "warning":
+		logMinLevel = levelWarn
+	case "error":
+		logMinLevel = levelError
+	default:
+		return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, not %v", level)
+	}
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+// stdLogWriter turns what the log package writes into log lines.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	ServiceLog.write(levelInfo, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+type requestIdKey struct{}
+
+// LoggerFor returns a logger for the request the context belongs to.
+func LoggerFor(ctx context.Context) *Logger {
+	l := &Logger{}
+	l.requestId, _ = ctx.Value(requestIdKey{}).(string)
+	if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+		l.traceId = span.TraceID().String()
+	}
+	return l
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.write(levelDebug, fmt.Sprintf(format, v...))
+}
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.write(levelInfo, fmt.Sprintf(format, v...))
+}
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.write(levelWarn, fmt.Sprintf(format, v...))
+}
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.write(levelError, fmt.Sprintf(format, v...))
+}
+
+// Fatalf logs the message as an error and exits.
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.write(levelError, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func (l *Logger) write(level logLevel, msg string) {
+	if level < logMinLevel {
+		return
+	}
+	line, err := json.Marshal(logLine{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     levelNames[level],
+		Service:   logService,
+		RequestId: l.requestId,
+		TraceId:   l.traceId,
+		Message:   msg,
+	})
+	if err != nil {
+		return
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	LogOutput.Write(append(line, '\n'))
+}
+
+// only ids that are short and plain are accepted from callers; anything else
+// is replaced so that it can't break the logs.
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// newRequestId returns a random id for a request that arrived without one.
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithRequestId gives each request the X-Request-ID it arrived with, or a new
+// one, and returns it on the response so that it is on every error.
+func WithRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if !requestIdPattern.MatchString(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+// SetRequestIdHeader passes the request's id on to the next service.
+func SetRequestIdHeader(req *http.Request) {
+	if id, ok := req.Context().Value(requestIdKey{}).(string); ok {
+		req.Header.Set(RequestIdHeader, id)
+	}
+}
+
+// HttpError is http.Error with the request's id added to the message so that
+// it can be quoted back when something goes wrong.
+func HttpError(w http.ResponseWriter, message string, code int) {
+	if id := w.Header().Get(RequestIdHeader); id != "" && !strings.Contains(message, id) {
+		message = fmt.Sprintf("%v (request id: %v)", message, id)
+	}
+	http.Error(w, message, code)
+}
@@ -0,0 +1,128 @@
+package platform
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "The number of requests handled, by route, method and status.",
+	}, []string{"route", "method", "status", "api_version"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "How long requests took to handle, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status", "api_version"})
+)
+
+// only the methods the services answer and versions that look like one are
+// used as labels so that clients can't create as many series as they like.
+var (
+	knownMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodPost:    true,
+		http.MethodPut:     true,
+		http.MethodPatch:   true,
+		http.MethodDelete:  true,
+		http.MethodOptions: true,
+	}
+	versionPattern = regexp.MustCompile(`^v[0-9]{1,3}$`)
+)
+
+type apiVersionKey struct{}
+
+// MethodOf is the request's method, or "other" if it isn't a known one.
+func MethodOf(r *http.Request) string {
+	if knownMethods[r.Method] {
+		return r.Method
+	}
+	return "other"
+}
+
+// ApiVersionOf is the x-api-version the request asked for, "none" if it
+// didn't ask for one or "other" if it isn't a version.
+func ApiVersionOf(r *http.Request) string {
+	version := r.Header.Get("x-api-version")
+	switch {
+	case version == "":
+		return "none"
+	case versionPattern.MatchString(version):
+		return version
+	default:
+		return "other"
+	}
+}
+
+// ApiVersionFrom is the label Measured saved for the request the context
+// belongs to, so that calls made for it are counted under the same version.
+func ApiVersionFrom(ctx context.Context) string {
+	if version, ok := ctx.Value(apiVersionKey{}).(string); ok {
+		return version
+	}
+	return "none"
+}
+
+// statusWriter remembers the status written to the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through so that streamed responses still stream.
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Measured counts and times each request under the route of routes that
+// handles it rather than its path, which keeps the number of series bounded.
+// Requests are labelled with apiVersion, or with the version they asked for
+// when it is empty.
+func Measured(routes *http.ServeMux, apiVersion string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := routes.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		version := apiVersion
+		if version == "" {
+			version = ApiVersionOf(r)
+		}
+		recorder := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		labels := prometheus.Labels{"route": route, "method": MethodOf(r), "status": strconv.Itoa(recorder.status), "api_version": version}
+		requestsTotal.With(labels).Inc()
+		requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,71 @@
+package platform
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	LogOutput = io.Discard
+	os.Exit(m.Run())
+}
+
+func TestDeadline(t *testing.T) {
+	var remaining time.Duration
+	handler := WithDeadline(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ := r.Context().Deadline()
+		remaining = time.Until(deadline)
+	}))
+
+	// the caller's budget is used when it is shorter than the limit
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TimeoutHeader, "500")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if remaining <= 0 || remaining > 500*time.Millisecond {
+		t.Fatalf("expected about 500ms to be left, got %v", remaining)
+	}
+
+	// a request with no time left is refused
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TimeoutHeader, "0")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %v", w.Code)
+	}
+}
+
+func TestMeasured(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+	})
+	handler := Measured(mux, "", mux)
+
+	// unknown methods and versions share a label and flushes pass through
+	req := httptest.NewRequest("BREW", "/", nil)
+	req.Header.Set("x-api-version", "coffee")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if !w.Flushed {
+		t.Fatalf("expected the flush to reach the response")
+	}
+	other := requestsTotal.WithLabelValues("/", "other", "200", "other")
+	if count := testutil.ToFloat64(other); count != 1 {
+		t.Fatalf("expected the request to be counted as other, got %v", count)
+	}
+
+	// known methods and versions keep their own
+	req = httptest.NewRequest("PATCH", "/", nil)
+	req.Header.Set("x-api-version", "v2")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if count := testutil.ToFloat64(requestsTotal.WithLabelValues("/", "PATCH", "200", "v2")); count != 1 {
+		t.Fatalf("expected the PATCH to be counted under v2, got %v", count)
+	}
+}
@@ -0,0 +1,70 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+)
+
+// SetupTracing installs a tracer provider that exports spans as chosen by
+// TRACES_EXPORTER: "otlp" sends them to OTEL_EXPORTER_OTLP_ENDPOINT,
+// "stdout" prints them and "file" appends them to TRACES_FILE. Anything else
+// turns tracing off. Trace context is always propagated with traceparent.
+func SetupTracing(ctx context.Context, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	noop := func(context.Context) error { return nil }
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName := os.Getenv("TRACES_EXPORTER"); exporterName {
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var file io.Writer
+		file, err = os.OpenFile(os.Getenv("TRACES_FILE"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	case "", "none":
+		ServiceLog.Infof("tracing is off.")
+		return noop, nil
+	default:
+		return noop, fmt.Errorf("TRACES_EXPORTER must be otlp, stdout, file or none, not %v", exporterName)
+	}
+	if err != nil {
+		return noop, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES can override the name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String(service)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return noop, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	ServiceLog.Infof("exporting traces with %v...", os.Getenv("TRACES_EXPORTER"))
+	return provider.Shutdown, nil
+}
+
+// Traced starts a span for each request, continuing the caller's trace.
+func Traced(service string, handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, service, otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+		return r.Method + " " + r.URL.Path
+	}))
+}
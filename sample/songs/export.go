@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+// the response is flushed to the client after this many songs.
+const exportFlushEvery = 100
+
+// exportFormat picks NDJSON or CSV from the Accept header in the order the
+// client listed them; NDJSON is the default.
+func exportFormat(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return "ndjson"
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(part))
+		switch mediaType {
+		case "application/x-ndjson", "application/ndjson", "application/jsonl", "*/*", "application/*":
+			return "ndjson"
+		case "text/csv", "text/*":
+			return "csv"
+		}
+	}
+	return ""
+}
+
+func export(w http.ResponseWriter, r *http.Request) {
+	format := exportFormat(r.Header.Get("Accept"))
+	if format == "" {
+		platform.HttpError(w, "the export is only available as NDJSON or CSV.", http.StatusNotAcceptable)
+		return
+	}
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		platform.HttpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// copy the matching songs so the mutex isn't held while writing
+	songMutex.RLock()
+	matched := []song{}
+	for _, x := range songs {
+		if opts.matches(x) {
+			matched = append(matched, x)
+		}
+	}
+	songMutex.RUnlock()
+	sort.Slice(matched, func(i, j int) bool {
+		return opts.before(opts.sortValue(matched[i]), matched[i].Id, opts.sortValue(matched[j]), matched[j].Id)
+	})
+
+	// write the header for the format
+	flusher, _ := w.(http.Flusher)
+	var csvWriter *csv.Writer
+	encoder := json.NewEncoder(w)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"songs.csv\"")
+		csvWriter = csv.NewWriter(w)
+		csvWriter.Write([]string{"id", "artist", "title", "genre"})
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"songs.ndjson\"")
+	}
+
+	// stream each song, flushing as we go
+	for i, val := range matched {
+		if csvWriter != nil {
+			err = csvWriter.Write([]string{strconv.Itoa(val.Id), val.Artist, val.Title, val.Genre})
+		} else {
+			err = encoder.Encode(val)
+		}
+		if err != nil {
+			platform.LoggerFor(r.Context()).Warnf("the export stopped after %v songs - %v", i, err)
+			return
+		}
+		if (i+1)%exportFlushEvery == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
+	platform.LoggerFor(r.Context()).Infof("exported %v songs.", len(matched))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// idempotencyRecord is what is remembered about a request made with an
+// Idempotency-Key; a status of 0 means the request is still in progress.
+type idempotencyRecord struct {
+	fingerprint string
+	status      int
+	contentType string
+	location    string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyStore remembers the response to each request made with an
+// Idempotency-Key until the key expires.
+type idempotencyStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	records   map[string]idempotencyRecord
+	nextSweep time.Time
+}
+
+var idempotencyKeys = newIdempotencyStore(24 * time.Hour)
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{ttl: ttl, records: map[string]idempotencyRecord{}}
+}
+
+// begin claims the key for a new request. If the key is already claimed the
+// existing record is returned instead.
+func (s *idempotencyStore) begin(key, fingerprint string) *idempotencyRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// drop expired keys every so often rather than on every request
+	now := time.Now()
+	if now.After(s.nextSweep) {
+		for k, record := range s.records {
+			if now.After(record.expires) {
+				delete(s.records, k)
+			}
+		}
+		s.nextSweep = now.Add(time.Minute)
+	}
+
+	if existing, ok := s.records[key]; ok && now.Before(existing.expires) {
+		return &existing
+	}
+	s.records[key] = idempotencyRecord{fingerprint: fingerprint, expires: now.Add(s.ttl)}
+	return nil
+}
+
+// complete saves the response so that it can be replayed.
+func (s *idempotencyStore) complete(key string, record idempotencyRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record.expires = time.Now().Add(s.ttl)
+	s.records[key] = record
+}
+
+// release forgets the key so that the request can be retried.
+func (s *idempotencyStore) release(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.records, key)
+}
+
+// requestFingerprint identifies a request so a key reused for a different
+// request can be detected.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter passes the response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent replays the original response when a request is repeated with
+// the same Idempotency-Key. Requests without the header are passed through.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeProblem(w, &problem{
+				Type:   "/problems/invalid-idempotency-key",
+				Title:  "the Idempotency-Key is too long.",
+				Status: http.StatusBadRequest,
+			})
+			return
+		}
+
+		// the body is needed for the fingerprint and again by the handler
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			platform.HttpError(w, "the body could not be read.", http.StatusBadRequest)
+			platform.LoggerFor(r.Context()).Warnf("the body could not be read - %v", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := requestFingerprint(r, body)
+
+		// claim the key or find out what happened to the earlier request
+		if existing := idempotencyKeys.begin(key, sum); existing != nil {
+			switch {
+			case existing.fingerprint != sum:
+				writeProblem(w, &problem{
+					Type:   "/problems/idempotency-key-reused",
+					Title:  "the Idempotency-Key was already used for a different request.",
+					Status: http.StatusUnprocessableEntity,
+				})
+			case existing.status == 0:
+				w.Header().Set("Retry-After", "1")
+				writeProblem(w, &problem{
+					Type:   "/problems/request-in-progress",
+					Title:  "a request with the Idempotency-Key is still in progress.",
+					Status: http.StatusConflict,
+				})
+			default:
+				platform.LoggerFor(r.Context()).Warnf("replaying the response for Idempotency-Key %v.", key)
+				if existing.contentType != "" {
+					w.Header().Set("Content-Type", existing.contentType)
+				}
+				if existing.location != "" {
+					w.Header().Set("Location", existing.location)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.status)
+				w.Write(existing.body)
+			}
+			return
+		}
+
+		// handle the request, remembering the response unless it failed in a
+		// way that is worth retrying
+		recorder := &recordingWriter{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.status == 0 || recorder.status >= 500 {
+			idempotencyKeys.release(key)
+			return
+		}
+		idempotencyKeys.complete(key, idempotencyRecord{
+			fingerprint: sum,
+			status:      recorder.status,
+			contentType: recorder.Header().Get("Content-Type"),
+			location:    recorder.Header().Get("Location"),
+			body:        recorder.body.Bytes(),
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+const maxImportLineSize = 64 * 1024
+
+type importRow struct {
+	Row        int    `json:"row"`
+	Id         *int   `json:"id,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ExistingId *int   `json:"existingId,omitempty"`
+}
+
+type importReport struct {
+	Imported int         `json:"imported"`
+	Failed   int         `json:"failed"`
+	Rows     []importRow `json:"rows"`
+}
+
+// importFormat determines whether the body is NDJSON or CSV from its
+// content type.
+func importFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return "ndjson"
+	case "text/csv":
+		return "csv"
+	}
+	return ""
+}
+
+// readImport calls fn with each row of the body, numbered from 1, and the
+// song on it or the reason the row could not be read.
+func readImport(body io.Reader, format string, fn func(row int, val song, err error)) error {
+	if format == "csv" {
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		for row := 1; ; row++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				fn(row, song{}, err)
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			// skip an optional header
+			if row == 1 && strings.EqualFold(strings.Join(record, ","), "artist,title,genre") {
+				continue
+			}
+			if len(record) != 3 {
+				fn(row, song{}, errors.New("the row must have the columns artist,title,genre."))
+				continue
+			}
+			fn(row, song{Artist: record[0], Title: record[1], Genre: record[2]}, nil)
+		}
+	}
+
+	reader := bufio.NewReader(body)
+	for row := 1; ; row++ {
+		line, err := readLine(reader)
+		if err == io.EOF {
+			return nil
+		} else if err == errLineTooLong {
+			fn(row, song{}, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var val song
+		if p := decodeStrict(strings.NewReader(line), &val); p != nil {
+			if len(p.Errors) > 0 {
+				fn(row, val, errors.New(describe(p.Errors)))
+			} else {
+				fn(row, val, errors.New(p.Title))
+			}
+			continue
+		}
+		fn(row, val, nil)
+	}
+}
+
+var errLineTooLong = errors.New("the row is longer than 64KB.")
+
+// readLine reads the next line without its line ending. The rest of a line
+// longer than maxImportLineSize is skipped and errLineTooLong returned so
+// that the row can be reported and the import carry on.
+func readLine(reader *bufio.Reader) (string, error) {
+	line := []byte{}
+	tooLong := false
+	for {
+		chunk, more, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if !tooLong && len(line)+len(chunk) > maxImportLineSize {
+			tooLong = true
+		} else if !tooLong {
+			line = append(line, chunk...)
+		}
+		if !more {
+			break
+		}
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return string(line), nil
+}
+
+func bulkImport(w http.ResponseWriter, r *http.Request) {
+	format := importFormat(r.Header.Get("Content-Type"))
+	if format == "" {
+		platform.HttpError(w, "the body must be NDJSON or CSV.", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// read and validate every row before changing the songs
+	report := importReport{Rows: []importRow{}}
+	valid := []song{}
+	validRows := []int{}
+	err := readImport(r.Body, format, func(row int, val song, err error) {
+		if err == nil {
+			if errs := validateSong(&val); len(errs) > 0 {
+				err = errors.New(describe(errs))
+			}
+		}
+		if err != nil {
+			report.Rows = append(report.Rows, importRow{Row: row, Error: err.Error()})
+			report.Failed++
+			return
+		}
+		valid = append(valid, val)
+		validRows = append(validRows, row)
+	})
+	if err != nil {
+		platform.HttpError(w, "the body could not be read.", http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("the import could not be read - %v", err)
+		return
+	}
+
+	// use a mutex to protect a change to the songs, once for the whole import
+	songMutex.Lock()
+	next := 0
+	for _, x := range songs {
+		if x.Id >= next {
+			next = x.Id + 1
+		}
+	}
+	// rows that repeat a stored song, or an earlier row, are reported
+	keys := map[string]int{}
+	unique := []song{}
+	uniqueRows := []int{}
+	for i, val := range valid {
+		key := songKey(val)
+		existingId, found := songKeys[key]
+		if !found {
+			existingId, found = keys[key]
+		}
+		if found {
+			existingId := existingId
+			report.Rows = append(report.Rows, importRow{
+				Row:        validRows[i],
+				Error:      fmt.Sprint("the song is a duplicate of ", existingId),
+				ExistingId: &existingId,
+			})
+			report.Failed++
+			continue
+		}
+		val.Id = next + len(unique)
+		keys[key] = val.Id
+		unique = append(unique, val)
+		uniqueRows = append(uniqueRows, validRows[i])
+	}
+	valid, validRows = unique, uniqueRows
+	entries := make([]journalEntry, len(valid))
+	for i := range valid {
+		entries[i] = journalEntry{"store", valid[i]}
+	}
+	err = songJournal.append(entries...)
+	if err != nil {
+		songMutex.Unlock()
+		platform.HttpError(w, "the songs could not be stored.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the songs could not be journalled - %v", err)
+		return
+	}
+	songs = append(songs, valid...)
+	for key, id := range keys {
+		songKeys[key] = id
+	}
+	songMutex.Unlock()
+
+	// report each row in the order it appeared
+	for i := range valid {
+		report.Rows = append(report.Rows, importRow{Row: validRows[i], Id: &valid[i].Id})
+	}
+	report.Imported = len(valid)
+	sort.Slice(report.Rows, func(i, j int) bool {
+		return report.Rows[i].Row < report.Rows[j].Row
+	})
+
+	// write JSON output
+	platform.LoggerFor(r.Context()).Infof("imported %v songs, %v rows failed.", report.Imported, report.Failed)
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		platform.HttpError(w, "the report could not be marshalled.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.HttpError(w, "the report could not be written.", http.StatusInternalServerError)
+		return
+	}
+}
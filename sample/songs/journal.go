@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+const snapshotFile = "songs.snapshot"
+const journalFile = "songs.journal"
+
+// each journal record is framed by a header holding the payload length and
+// its CRC so that a torn or corrupt write at the end can be detected.
+const recordHeaderSize = 8
+
+type journalEntry struct {
+	Op   string `json:"op"`
+	Song song   `json:"song"`
+}
+
+type journal struct {
+	dir  string
+	file *os.File
+}
+
+// songJournal is nil unless DATA_DIR is set, in which case every change to
+// the songs is appended to it before it is applied.
+var songJournal *journal
+
+// openJournal restores the songs from the snapshot and journal in dir and
+// opens the journal for appending.
+func openJournal(dir string) (*journal, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// start from the last snapshot, if there is one
+	bytes, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		var restored []song
+		err = json.Unmarshal(bytes, &restored)
+		if err != nil {
+			return nil, err
+		}
+		songs = restored
+		platform.ServiceLog.Infof("restored %v songs from the snapshot.", len(songs))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// replay everything that happened since
+	file, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	count, valid, err := replay(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	platform.ServiceLog.Infof("replayed %v entries from the journal.", count)
+
+	// drop anything after the last good record
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() > valid {
+		platform.ServiceLog.Infof("truncating %v bytes of corrupt records from the journal.", info.Size()-valid)
+		err = file.Truncate(valid)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	_, err = file.Seek(valid, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &journal{dir: dir, file: file}, nil
+}
+
+// replay applies every intact record and returns the offset just past the
+// last one; reading stops at the first incomplete or corrupt record.
+func replay(file *os.File) (int, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	reader := bufio.NewReader(file)
+	header := make([]byte, recordHeaderSize)
+	var count int
+	var valid int64
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return count, valid, nil
+		} else if err != nil {
+			return count, valid, err
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+
+		// a damaged length can't be trusted to size the payload; a record
+		// longer than what is left of the file is a corrupt tail
+		if int64(size) > info.Size()-valid-recordHeaderSize {
+			return count, valid, nil
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(reader, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return count, valid, nil
+		} else if err != nil {
+			return count, valid, err
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return count, valid, nil
+		}
+		var entry journalEntry
+		if json.Unmarshal(payload, &entry) != nil {
+			return count, valid, nil
+		}
+		applyEntry(entry)
+		count++
+		valid += int64(recordHeaderSize) + int64(size)
+	}
+}
+
+// applyEntry changes the songs as described by the entry. Applying an entry
+// twice has no further effect so a journal can be replayed over a snapshot
+// that already contains some of it. The caller must hold songMutex.
+func applyEntry(entry journalEntry) {
+	index := indexOfSong(entry.Song.Id)
+	switch entry.Op {
+	case "store", "update":
+		if index < 0 {
+			songs = append(songs, entry.Song)
+		} else {
+			songs[index] = entry.Song
+		}
+	case "delete":
+		if index >= 0 {
+			songs = append(songs[:index], songs[index+1:]...)
+		}
+	}
+}
+
+// append durably writes the entries; it does nothing when there is no
+// journal. The caller must hold songMutex.
+func (j *journal) append(entries ...journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	var buf []byte
+	for _, entry := range entries {
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, recordHeaderSize)
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+		buf = append(buf, header...)
+		buf = append(buf, payload...)
+	}
+	_, err := j.file.Write(buf)
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// snapshot writes all songs to the snapshot file and then empties the
+// journal. The caller must hold songMutex.
+func (j *journal) snapshot() error {
+	bytes, err := json.Marshal(songs)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it so the snapshot is never partial
+	path := filepath.Join(j.dir, snapshotFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(bytes)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	// the journal is only needed for changes after the snapshot
+	err = j.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// snapshotEvery takes a snapshot on every tick of the interval.
+func (j *journal) snapshotEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		songMutex.Lock()
+		err := j.snapshot()
+		count := len(songs)
+		songMutex.Unlock()
+		if err != nil {
+			platform.ServiceLog.Errorf("the snapshot could not be written - %v", err)
+		} else {
+			platform.ServiceLog.Infof("wrote a snapshot of %v songs.", count)
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/plasne/aks-lab/sample/platform"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type song struct {
@@ -49,6 +53,39 @@ var songs = []song{
 
 var songMutex sync.RWMutex
 
+// indexOfSong finds the position of the song with the id or returns -1. The
+// caller must hold songMutex.
+func indexOfSong(id int) int {
+	for i, x := range songs {
+		if x.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// songKeys maps the normalised artist and title of every song to its id so
+// duplicates can be found without a scan. The caller must hold songMutex.
+var songKeys = map[string]int{}
+
+// songKey identifies a song by its artist and title, ignoring case and
+// differences in whitespace, so duplicates can be detected.
+func songKey(val song) string {
+	normalize := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+	return normalize(val.Artist) + "\x1f" + normalize(val.Title)
+}
+
+// indexSongKeys rebuilds songKeys from the songs. The caller must hold
+// songMutex.
+func indexSongKeys() {
+	songKeys = make(map[string]int, len(songs))
+	for _, x := range songs {
+		songKeys[songKey(x)] = x.Id
+	}
+}
+
 func retrieve(w http.ResponseWriter, r *http.Request) {
 	// use a mutex to safely read from the songs
 	songMutex.RLock()
@@ -57,7 +94,7 @@ func retrieve(w http.ResponseWriter, r *http.Request) {
 	// get a valid id
 	id, err := strconv.Atoi(r.URL.Query().Get("id"))
 	if err != nil {
-		http.Error(w, "a valid ID was not provided.", http.StatusBadRequest)
+		platform.HttpError(w, "a valid ID was not provided.", http.StatusBadRequest)
 		return
 	}
 
@@ -70,21 +107,21 @@ func retrieve(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if val == nil {
-		http.Error(w, "the ID was out-of-range.", http.StatusBadRequest)
+		platform.HttpError(w, "the ID was out-of-range.", http.StatusBadRequest)
 		return
 	}
 
 	// write JSON output
-	log.Printf("retrieving song id %v.\n", id)
+	platform.LoggerFor(r.Context()).Infof("retrieving song id %v.", id)
 	bytes, err := json.Marshal(val)
 	if err != nil {
-		http.Error(w, "the song could not be marshalled.", http.StatusInternalServerError)
+		platform.HttpError(w, "the song could not be marshalled.", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	_, err = w.Write(bytes)
 	if err != nil {
-		http.Error(w, "the song could not be written.", http.StatusInternalServerError)
+		platform.HttpError(w, "the song could not be written.", http.StatusInternalServerError)
 		return
 	}
 }
@@ -92,54 +129,285 @@ func retrieve(w http.ResponseWriter, r *http.Request) {
 func store(w http.ResponseWriter, r *http.Request) {
 	// append the song
 	var val song
-	err := json.NewDecoder(r.Body).Decode(&val)
-	if err != nil {
-		http.Error(w, "the body could not be decoded.", http.StatusBadRequest)
+	if p := decodeStrict(r.Body, &val); p != nil {
+		writeProblem(w, p)
+		return
+	}
+	if errs := validateSong(&val); len(errs) > 0 {
+		writeProblem(w, invalidSong(errs))
 		return
 	}
 
 	// use a mutex to protect a change to the songs
 	songMutex.Lock()
+	if existingId, found := songKeys[songKey(val)]; found {
+		songMutex.Unlock()
+		writeDuplicate(w, existingId)
+		platform.LoggerFor(r.Context()).Warnf("the song is a duplicate of %v.", existingId)
+		return
+	}
 	for _, x := range songs {
 		if x.Id >= val.Id {
 			val.Id = x.Id + 1
 		}
 	}
+	err := songJournal.append(journalEntry{"store", val})
+	if err != nil {
+		songMutex.Unlock()
+		platform.HttpError(w, "the song could not be stored.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be journalled - %v", err)
+		return
+	}
 	songs = append(songs, val)
+	songKeys[songKey(val)] = val.Id
 	songMutex.Unlock()
 
 	// write JSON output
-	log.Printf("storing song id %v.\n", val.Id)
+	platform.LoggerFor(r.Context()).Infof("storing song id %v.", val.Id)
 	bytes, err := json.Marshal(val)
 	if err != nil {
-		http.Error(w, "the song could not be marshalled.", http.StatusInternalServerError)
+		platform.HttpError(w, "the song could not be marshalled.", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprint("/?id=", val.Id))
+	w.WriteHeader(http.StatusCreated)
 	_, err = w.Write(bytes)
 	if err != nil {
-		http.Error(w, "the song could not be returned.", http.StatusInternalServerError)
+		platform.HttpError(w, "the song could not be returned.", http.StatusInternalServerError)
 		return
 	}
 }
 
-func main() {
-	godotenv.Load()
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+type songPatch struct {
+	Artist *string `json:"artist"`
+	Title  *string `json:"title"`
+	Genre  *string `json:"genre"`
+}
+
+// isEmpty is true if the patch doesn't set any field.
+func (p songPatch) isEmpty() bool {
+	return p.Artist == nil && p.Title == nil && p.Genre == nil
+}
+
+// apply copies every field that was present in the patch onto the song.
+func (p songPatch) apply(val *song) {
+	if p.Artist != nil {
+		val.Artist = *p.Artist
+	}
+	if p.Title != nil {
+		val.Title = *p.Title
+	}
+	if p.Genre != nil {
+		val.Genre = *p.Genre
+	}
+}
+
+func update(w http.ResponseWriter, r *http.Request) {
+	// get a valid id
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		platform.HttpError(w, "a valid ID was not provided.", http.StatusBadRequest)
+		return
+	}
+
+	// PUT replaces the song, PATCH only changes the fields provided
+	var val song
+	var patch songPatch
+	if r.Method == "PATCH" {
+		if p := decodeStrict(r.Body, &patch); p != nil {
+			writeProblem(w, p)
+			return
+		}
+		if patch.isEmpty() {
+			platform.HttpError(w, "no fields were provided to update.", http.StatusBadRequest)
+			return
+		}
+		if errs := validatePatch(&patch); len(errs) > 0 {
+			writeProblem(w, invalidSong(errs))
+			return
+		}
+	} else {
+		if p := decodeStrict(r.Body, &val); p != nil {
+			writeProblem(w, p)
+			return
+		}
+		if errs := validateSong(&val); len(errs) > 0 {
+			writeProblem(w, invalidSong(errs))
+			return
+		}
+	}
+
+	// use a mutex to protect a change to the songs
+	songMutex.Lock()
+	index := indexOfSong(id)
+	if index < 0 {
+		songMutex.Unlock()
+		platform.HttpError(w, "no song with that id was found.", http.StatusNotFound)
+		return
+	}
+	if r.Method == "PATCH" {
+		val = songs[index]
+		patch.apply(&val)
+	}
+	val.Id = id
+	if existingId, found := songKeys[songKey(val)]; found && existingId != id {
+		songMutex.Unlock()
+		writeDuplicate(w, existingId)
+		platform.LoggerFor(r.Context()).Warnf("the update would duplicate %v.", existingId)
+		return
+	}
+	err = songJournal.append(journalEntry{"update", val})
+	if err != nil {
+		songMutex.Unlock()
+		platform.HttpError(w, "the song could not be updated.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be journalled - %v", err)
+		return
+	}
+	delete(songKeys, songKey(songs[index]))
+	songKeys[songKey(val)] = id
+	songs[index] = val
+	songMutex.Unlock()
+
+	// write JSON output
+	platform.LoggerFor(r.Context()).Infof("updating song id %v.", id)
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		platform.HttpError(w, "the song could not be marshalled.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.HttpError(w, "the song could not be returned.", http.StatusInternalServerError)
+		return
+	}
+}
+
+func remove(w http.ResponseWriter, r *http.Request) {
+	// get a valid id
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		platform.HttpError(w, "a valid ID was not provided.", http.StatusBadRequest)
+		return
+	}
+
+	// use a mutex to protect a change to the songs
+	songMutex.Lock()
+	index := indexOfSong(id)
+	if index < 0 {
+		songMutex.Unlock()
+		platform.HttpError(w, "no song with that id was found.", http.StatusNotFound)
+		return
+	}
+	err = songJournal.append(journalEntry{"delete", songs[index]})
+	if err != nil {
+		songMutex.Unlock()
+		platform.HttpError(w, "the song could not be deleted.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be journalled - %v", err)
+		return
+	}
+	delete(songKeys, songKey(songs[index]))
+	songs = append(songs[:index], songs[index+1:]...)
+	songMutex.Unlock()
+
+	platform.LoggerFor(r.Context()).Infof("deleted song id %v.", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newHandler routes requests to the handlers.
+func newHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if r.URL.Query().Get("id") == "" {
+				list(w, r)
+			} else {
+				retrieve(w, r)
+			}
+		case "POST":
+			idempotent(store)(w, r)
+		case "PUT", "PATCH":
+			update(w, r)
+		case "DELETE":
+			remove(w, r)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
-			retrieve(w, r)
+			search(w, r)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			export(w, r)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
 		case "POST":
-			store(w, r)
+			bulkImport(w, r)
 		default:
-			http.Error(w, "the method is not implemented.", http.StatusNotImplemented)
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
 		}
 	})
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+func main() {
+	godotenv.Load()
+	if err := platform.SetupLogging("songs"); err != nil {
+		platform.ServiceLog.Fatalf("unable to set up logging - %v", err)
+	}
+	shutdown, err := platform.SetupTracing(context.Background(), "songs")
+	if err != nil {
+		platform.ServiceLog.Fatalf("unable to set up tracing - %v", err)
+	}
+	defer shutdown(context.Background())
+	loadAllowedGenres()
+
+	// optionally persist the songs to disk, with a snapshot every
+	// SNAPSHOT_INTERVAL seconds (5 minutes if it isn't a positive number)
+	if dataDir := os.Getenv("DATA_DIR"); dataDir != "" {
+		interval, err := strconv.Atoi(os.Getenv("SNAPSHOT_INTERVAL"))
+		if err != nil || interval <= 0 {
+			interval = 300
+		}
+		songJournal, err = openJournal(dataDir)
+		if err != nil {
+			platform.ServiceLog.Fatalf("unable to open the data in %v - %v", dataDir, err)
+		}
+		platform.ServiceLog.Infof("persisting songs to %v with a snapshot every %v seconds...", dataDir, interval)
+		go songJournal.snapshotEvery(time.Duration(interval) * time.Second)
+	}
+	indexSongKeys()
+
+	// remember responses to requests with an Idempotency-Key for a day by default
+	if ttl, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL")); err == nil {
+		idempotencyKeys = newIdempotencyStore(time.Duration(ttl) * time.Second)
+	}
+
+	mux := newHandler()
 	port, err := strconv.Atoi(os.Getenv("PORT"))
 	if err != nil {
 		port = 80
 	}
-	log.Printf("listening on port %v...\n", port)
-	err = http.ListenAndServe(fmt.Sprint(":", port), nil)
-	log.Fatal(err)
+
+	// requests are limited to the time the caller has left and, optionally,
+	// to REQUEST_TIMEOUT_MS
+	timeoutMs, _ := strconv.Atoi(os.Getenv("REQUEST_TIMEOUT_MS"))
+	platform.ServiceLog.Infof("listening on port %v...", port)
+	handler := platform.WithDeadline(time.Duration(timeoutMs)*time.Millisecond, mux)
+	err = http.ListenAndServe(fmt.Sprint(":", port), platform.Traced("songs", platform.WithRequestId(platform.Measured(mux, apiVersion, handler))))
+	platform.ServiceLog.Fatalf("%v", err)
 }
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+// seed is the catalog the service starts with, restored before each test.
+var seed []song
+
+func TestMain(m *testing.M) {
+	platform.LogOutput = io.Discard
+	seed = append([]song{}, songs...)
+	os.Exit(m.Run())
+}
+
+// reset puts the songs back to the seed with no journal or remembered keys.
+func reset(t *testing.T) {
+	t.Helper()
+	songMutex.Lock()
+	defer songMutex.Unlock()
+	songs = append([]song{}, seed...)
+	indexSongKeys()
+	songJournal = nil
+	idempotencyKeys = newIdempotencyStore(time.Hour)
+}
+
+// do sends a request to the handler and returns the response.
+func do(t *testing.T, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	newHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestUpdate(t *testing.T) {
+	reset(t)
+
+	// PATCH only changes the fields provided
+	w := do(t, "PATCH", "/?id=0", `{"title":"In My Feelings (Remix)"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	var val song
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val.Title != "In My Feelings (Remix)" || val.Artist != "Drake" || val.Genre != "HipHop" {
+		t.Fatalf("unexpected song after PATCH %+v", val)
+	}
+
+	// PUT replaces every field
+	w = do(t, "PUT", "/?id=0", `{"artist":"Drake","title":"Nonstop"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val.Title != "Nonstop" || val.Genre != "" || val.Id != 0 {
+		t.Fatalf("unexpected song after PUT %+v", val)
+	}
+
+	w = do(t, "PATCH", "/?id=999", `{"title":"x"}`)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown id, got %v", w.Code)
+	}
+	w = do(t, "PATCH", "/?id=0", `{}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty patch, got %v", w.Code)
+	}
+}
+
+// record frames the payload as the journal does, with the length and CRC
+// given rather than worked out.
+func record(size, sum uint32, payload []byte) []byte {
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], size)
+	binary.BigEndian.PutUint32(header[4:8], sum)
+	return append(header, payload...)
+}
+
+func TestJournalReplay(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	j, err := openJournal(dir)
+	if err != nil {
+		t.Fatalf("the journal could not be opened - %v", err)
+	}
+	err = j.append(
+		journalEntry{"store", song{Id: 100, Artist: "Lizzo", Title: "Juice", Genre: "Pop"}},
+		journalEntry{"update", song{Id: 0, Artist: "Drake", Title: "Nonstop", Genre: "HipHop"}},
+		journalEntry{"delete", song{Id: 1}},
+	)
+	if err != nil {
+		t.Fatalf("the entries could not be journalled - %v", err)
+	}
+	j.file.Close()
+
+	reset(t)
+	j, err = openJournal(dir)
+	if err != nil {
+		t.Fatalf("the journal could not be reopened - %v", err)
+	}
+	defer j.file.Close()
+	if len(songs) != len(seed) || indexOfSong(100) < 0 || indexOfSong(1) >= 0 || songs[indexOfSong(0)].Title != "Nonstop" {
+		t.Fatalf("the journal was not replayed, got %+v", songs)
+	}
+}
+
+func TestJournalCorruptTail(t *testing.T) {
+	good, _ := json.Marshal(journalEntry{"store", song{Id: 100, Artist: "Lizzo", Title: "Juice", Genre: "Pop"}})
+	bad, _ := json.Marshal(journalEntry{"store", song{Id: 101, Artist: "Lizzo", Title: "Truth Hurts", Genre: "Pop"}})
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"bad CRC", record(uint32(len(bad)), crc32.ChecksumIEEE(bad)+1, bad)},
+		{"short header", []byte{0, 0, 0}},
+		{"short payload", record(uint32(len(bad)), crc32.ChecksumIEEE(bad), bad[:10])},
+		{"oversized length", record(0xFFFFFFFF, crc32.ChecksumIEEE(bad), bad)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reset(t)
+			dir := t.TempDir()
+			intact := record(uint32(len(good)), crc32.ChecksumIEEE(good), good)
+			err := os.WriteFile(filepath.Join(dir, journalFile), append(intact, test.tail...), 0644)
+			if err != nil {
+				t.Fatalf("the journal could not be written - %v", err)
+			}
+
+			// the intact record is replayed and the tail is cut off
+			j, err := openJournal(dir)
+			if err != nil {
+				t.Fatalf("the journal could not be opened - %v", err)
+			}
+			defer j.file.Close()
+			if indexOfSong(100) < 0 || indexOfSong(101) >= 0 {
+				t.Fatalf("expected only the intact record to be replayed, got %+v", songs)
+			}
+			info, err := os.Stat(filepath.Join(dir, journalFile))
+			if err != nil {
+				t.Fatalf("the journal could not be read - %v", err)
+			}
+			if info.Size() != int64(len(intact)) {
+				t.Fatalf("expected the journal to be truncated to %v bytes, got %v", len(intact), info.Size())
+			}
+		})
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	reset(t)
+
+	// walk every page of rap songs sorted by title
+	titles := []string{}
+	target := "/?genre=Rap&sort=title&limit=2"
+	for pages := 0; target != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		w := do(t, "GET", target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+		}
+		var result page
+		json.Unmarshal(w.Body.Bytes(), &result)
+		for _, x := range result.Items {
+			titles = append(titles, x.Title)
+		}
+		target = ""
+		if result.NextCursor != "" {
+			target = "/?genre=Rap&sort=title&limit=2&cursor=" + result.NextCursor
+		}
+	}
+	expected := "Barbie Dreams,Better Now,Lucid Dreams,Lucky You,The Ringer"
+	if strings.Join(titles, ",") != expected {
+		t.Fatalf("expected %v, got %v", expected, strings.Join(titles, ","))
+	}
+
+	// the offset skips songs and descending sorts reverse the order
+	w := do(t, "GET", "/?artist=eminem&sort=-title&offset=1", "")
+	var result page
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 1 || result.Items[0].Title != "Lucky You" {
+		t.Fatalf("expected Lucky You after the offset, got %+v", result.Items)
+	}
+
+	w = do(t, "GET", "/?sort=length", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown sort, got %v", w.Code)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	reset(t)
+
+	// a match in the title ranks above one in the artist
+	w := do(t, "GET", "/search?q=summer", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	var result searchResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 2 || result.Items[0].Id != 20 || result.Items[1].Id != 11 {
+		t.Fatalf("expected songs 20 and 11, got %+v", result.Items)
+	}
+
+	// songs matching more of the query rank higher, and the limit applies
+	w = do(t, "GET", "/search?q=Lucid+Dreams&limit=1", "")
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 1 || result.Items[0].Title != "Lucid Dreams" {
+		t.Fatalf("expected only Lucid Dreams, got %+v", result.Items)
+	}
+
+	w = do(t, "GET", "/search", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a query, got %v", w.Code)
+	}
+}
+
+// send sends a request with the content type or accept header to the handler.
+func send(t *testing.T, method, target, header, value, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(header, value)
+	w := httptest.NewRecorder()
+	newHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestBulkImport(t *testing.T) {
+	reset(t)
+	tests := []struct {
+		contentType string
+		body        string
+		imported    int
+		failed      int
+	}{
+		{"text/csv", "artist,title,genre\nOh Hellos,Boreas,Folk\n,No Artist,Pop\nA,B\nweezer,AFRICA,Rock\n", 1, 3},
+		{"application/x-ndjson", "{\"artist\":\"A\",\"title\":\"B\"}\n\nnot json\n{\"artist\":\"C\"}\n", 1, 2},
+		{"application/x-ndjson", "{\"artist\":\"" + strings.Repeat("x", maxImportLineSize) + "\"}\n{\"artist\":\"Khalid\",\"title\":\"Talk\",\"genre\":\"Pop\"}\n", 1, 1},
+	}
+	for _, test := range tests {
+		w := send(t, "POST", "/import", "Content-Type", test.contentType, test.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %v", test.contentType, w.Code)
+		}
+		var report importReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		if report.Imported != test.imported || report.Failed != test.failed {
+			t.Errorf("%v: expected %v imported and %v failed, got %+v", test.contentType, test.imported, test.failed, report)
+		}
+		for _, row := range report.Rows {
+			if row.Error == "" && row.Id == nil {
+				t.Errorf("%v: row %v was imported without an id", test.contentType, row.Row)
+			}
+		}
+	}
+
+	// the duplicate of a song already in the catalog names it
+	w := send(t, "POST", "/import", "Content-Type", "text/csv", "Weezer,Africa,Rock\n")
+	var report importReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Failed != 1 || report.Rows[0].ExistingId == nil || *report.Rows[0].ExistingId != 21 {
+		t.Fatalf("expected the duplicate of song 21, got %+v", report)
+	}
+
+	// the imported songs are given the next ids
+	w = do(t, "GET", "/?id=25", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Boreas") {
+		t.Fatalf("expected Boreas to be song 25, got %v: %v", w.Code, w.Body.String())
+	}
+	if len(songs) != len(seed)+3 {
+		t.Fatalf("expected 3 imported songs, got %v", len(songs)-len(seed))
+	}
+
+	w = do(t, "POST", "/import", "")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 without a content type, got %v", w.Code)
+	}
+}
+
+func TestExport(t *testing.T) {
+	reset(t)
+	tests := []struct {
+		accept      string
+		contentType string
+		lines       int
+	}{
+		{"", "application/x-ndjson", 2},
+		{"text/csv", "text/csv", 3},
+		{"application/xml, text/csv;q=0.5", "text/csv", 3},
+	}
+	for _, test := range tests {
+		w := send(t, "GET", "/export?artist=eminem&sort=-title", "Accept", test.accept, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %v", test.accept, w.Code)
+		}
+		if w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%v: expected %v, got %v", test.accept, test.contentType, w.Header().Get("Content-Type"))
+		}
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if len(lines) != test.lines {
+			t.Errorf("%v: expected %v lines, got %v", test.accept, test.lines, len(lines))
+		}
+		if !strings.Contains(lines[len(lines)-1], "Lucky You") {
+			t.Errorf("%v: expected Lucky You last, got %v", test.accept, lines[len(lines)-1])
+		}
+	}
+
+	w := send(t, "GET", "/export", "Accept", "application/xml", "")
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("expected 406 for xml, got %v", w.Code)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	reset(t)
+	os.Setenv("ALLOWED_GENRES", "HipHop,Pop")
+	loadAllowedGenres()
+	defer func() {
+		os.Unsetenv("ALLOWED_GENRES")
+		loadAllowedGenres()
+	}()
+	tests := []struct {
+		body   string
+		fields []string
+	}{
+		{`{"artist":"","title":"  "}`, []string{"artist", "title"}},
+		{`{"artist":"Drake","title":"` + strings.Repeat("x", 201) + `"}`, []string{"title"}},
+		{`{"artist":"Drake","title":"Nonstop","genre":"Polka"}`, []string{"genre"}},
+		{`{"artist":"Drake","title":"Nonstop","year":2018}`, []string{"year"}},
+		{`{"artist":42,"title":"Nonstop"}`, []string{"artist"}},
+	}
+	for _, test := range tests {
+		w := do(t, "POST", "/", test.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %v", test.body, w.Code)
+			continue
+		}
+		if w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("%v: expected a problem, got %v", test.body, w.Header().Get("Content-Type"))
+		}
+		var p problem
+		json.Unmarshal(w.Body.Bytes(), &p)
+		fields := []string{}
+		for _, e := range p.Errors {
+			fields = append(fields, e.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") {
+			t.Errorf("%v: expected errors for %v, got %+v", test.body, test.fields, p.Errors)
+		}
+	}
+
+	// the genre is stored with the configured spelling
+	w := do(t, "POST", "/", `{"artist":"Drake","title":"Nonstop","genre":"hiphop"}`)
+	var stored song
+	json.Unmarshal(w.Body.Bytes(), &stored)
+	if w.Code != http.StatusCreated || stored.Genre != "HipHop" {
+		t.Fatalf("expected the genre HipHop, got %v: %v", w.Code, w.Body.String())
+	}
+	w = do(t, "PATCH", "/?id=0", `{"title":""}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 blanking the title, got %v", w.Code)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	reset(t)
+
+	// case and whitespace don't make a song different
+	w := do(t, "POST", "/", `{"artist":"khalid  &  normani","title":"LOVE LIES","genre":"HipHop"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %v: %v", w.Code, w.Body.String())
+	}
+	var p problem
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if p.ExistingId == nil || *p.ExistingId != 10 || w.Header().Get("Location") != "/?id=10" {
+		t.Fatalf("expected the existing id 10, got %+v", p)
+	}
+
+	// an update can't turn one song into a copy of another, but can rewrite
+	// a song in place
+	body := `{"artist":"Khalid & Normani","title":"Love Lies","genre":"HipHop"}`
+	w = do(t, "PUT", "/?id=0", body)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 updating into a duplicate, got %v", w.Code)
+	}
+	p = problem{}
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if p.ExistingId == nil || *p.ExistingId != 10 {
+		t.Fatalf("expected the existing id 10, got %+v", p)
+	}
+	w = do(t, "PUT", "/?id=10", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 updating a song in place, got %v", w.Code)
+	}
+	if len(songs) != len(seed) || songs[indexOfSong(0)].Title != "In My Feelings" {
+		t.Fatalf("expected the songs to be unchanged, got %+v", songs)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	reset(t)
+	post := func(key, body string) *httptest.ResponseRecorder {
+		return send(t, "POST", "/", "Idempotency-Key", key, body)
+	}
+
+	// a retry gets the original response and doesn't store the song again
+	first := post("abc", `{"artist":"Tyga","title":"Dip"}`)
+	second := post("abc", `{"artist":"Tyga","title":"Dip"}`)
+	if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+		t.Fatalf("expected 201 twice, got %v and %v", first.Code, second.Code)
+	}
+	if second.Header().Get("Location") != first.Header().Get("Location") {
+		t.Fatalf("expected the Location to be replayed, got %v", second.Header().Get("Location"))
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected the first response to be replayed, got %v", second.Body.String())
+	}
+
+	// the same key with a different body is rejected
+	w := post("abc", `{"artist":"Tyga","title":"Rack City"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %v", w.Code)
+	}
+
+	// a client error is replayed too, but a new key goes through
+	w = post("def", `{"artist":""}`)
+	if w.Code != http.StatusBadRequest || post("def", `{"artist":""}`).Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 to be replayed, got %v", w.Code)
+	}
+	if w = post("ghi", `{"artist":"Tyga","title":"Rack City"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 with a new key, got %v", w.Code)
+	}
+	if len(songs) != len(seed)+2 {
+		t.Fatalf("expected 2 new songs, got %v", len(songs)-len(seed))
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	keys := newIdempotencyStore(-time.Second)
+	keys.begin("abc", "one")
+	if existing := keys.begin("abc", "two"); existing != nil {
+		t.Fatal("expected an expired key to be claimed again")
+	}
+}
+
+func TestExportFlushesThroughMiddleware(t *testing.T) {
+	reset(t)
+	rows := []string{}
+	for i := len(songs); i < exportFlushEvery; i++ {
+		rows = append(rows, fmt.Sprintf("Artist %v,Title %v,Pop", i, i))
+	}
+	send(t, "POST", "/import", "Content-Type", "text/csv", strings.Join(rows, "\n"))
+
+	// the export is streamed through the same middleware as in main
+	mux := newHandler()
+	handler := platform.Traced("songs", platform.WithRequestId(platform.Measured(mux, apiVersion, platform.WithDeadline(0, mux))))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/export", nil))
+	if w.Code != http.StatusOK || !w.Flushed {
+		t.Fatalf("expected the export to be flushed, got %v flushed %v", w.Code, w.Flushed)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	catalogSize = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "songs_catalog_size",
+		Help:        "The number of songs held in memory.",
+		ConstLabels: prometheus.Labels{"api_version": apiVersion},
+	}, func() float64 {
+		songMutex.RLock()
+		defer songMutex.RUnlock()
+		return float64(len(songs))
+	})
+)
+
+// apiVersion is the x-api-version this service answers to. Every metric is
+// labelled with it so the versions can be compared during a canary.
+const apiVersion = "v1"
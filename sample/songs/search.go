@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+// the relative importance of a match in each field; these are the weights
+// songs v2 uses so that both versions rank alike.
+var searchWeights = map[string]int{
+	"title":  3,
+	"artist": 2,
+	"genre":  1,
+}
+
+type searchHit struct {
+	song
+	Score float64 `json:"score"`
+}
+
+type searchResult struct {
+	Items []searchHit `json:"items"`
+}
+
+// tokenize splits text into lower-case words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// weightedTokens counts each token in the song, weighted by the field it is in.
+func weightedTokens(val song) map[string]int {
+	weights := map[string]int{}
+	fields := map[string]string{"title": val.Title, "artist": val.Artist, "genre": val.Genre}
+	for field, text := range fields {
+		for _, token := range tokenize(text) {
+			weights[token] += searchWeights[field]
+		}
+	}
+	return weights
+}
+
+// searchSongs scores every song containing a query token by the weighted term
+// frequency times the inverse document frequency of each token; the catalog
+// is small enough to scan rather than index.
+func searchSongs(query string, limit int) []searchHit {
+	songMutex.RLock()
+	tokens := make([]map[string]int, len(songs))
+	counts := map[string]int{}
+	for i, x := range songs {
+		tokens[i] = weightedTokens(x)
+		for token := range tokens[i] {
+			counts[token]++
+		}
+	}
+	hits := []searchHit{}
+	total := float64(len(songs))
+	for i, x := range songs {
+		score := 0.0
+		for _, token := range tokenize(query) {
+			if weight := tokens[i][token]; weight > 0 {
+				score += float64(weight) * math.Log(1+total/float64(counts[token]))
+			}
+		}
+		if score > 0 {
+			hits = append(hits, searchHit{song: x, Score: score})
+		}
+	}
+	songMutex.RUnlock()
+
+	// order by descending score, breaking ties by id
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score == hits[j].Score {
+			return hits[i].Id < hits[j].Id
+		}
+		return hits[i].Score > hits[j].Score
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+func search(w http.ResponseWriter, r *http.Request) {
+	// get the query and limit
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		platform.HttpError(w, "a search query was not provided.", http.StatusBadRequest)
+		return
+	}
+	limit := defaultListLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			platform.HttpError(w, "limit must be a number between 1 and 100.", http.StatusBadRequest)
+			return
+		}
+	}
+	hits := searchSongs(query, limit)
+
+	// write JSON output
+	platform.LoggerFor(r.Context()).Infof("found %v songs matching \"%v\".", len(hits), query)
+	bytes, err := json.Marshal(searchResult{Items: hits})
+	if err != nil {
+		platform.HttpError(w, "the songs could not be marshalled.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.HttpError(w, "the songs could not be written.", http.StatusInternalServerError)
+		return
+	}
+}
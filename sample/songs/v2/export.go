@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+// the response is flushed to the client after this many songs.
+const exportFlushEvery = 100
+
+// exportFormat picks NDJSON or CSV from the Accept header in the order the
+// client listed them; NDJSON is the default.
+func exportFormat(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return "ndjson"
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(part))
+		switch mediaType {
+		case "application/x-ndjson", "application/ndjson", "application/jsonl", "*/*", "application/*":
+			return "ndjson"
+		case "text/csv", "text/*":
+			return "csv"
+		}
+	}
+	return ""
+}
+
+func export(w http.ResponseWriter, r *http.Request, songStore SongStore) {
+	format := exportFormat(r.Header.Get("Accept"))
+	if format == "" {
+		platform.HttpError(w, "the export is only available as NDJSON or CSV.", http.StatusNotAcceptable)
+		return
+	}
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		platform.HttpError(w, err.Error(), http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("the export options were not valid - %v", err)
+		return
+	}
+	opts.after = nil
+
+	// write the header for the format
+	flusher, _ := w.(http.Flusher)
+	var csvWriter *csv.Writer
+	encoder := json.NewEncoder(w)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"songs.csv\"")
+		csvWriter = csv.NewWriter(w)
+		csvWriter.Write([]string{"id", "artist", "title", "genre"})
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"songs.ndjson\"")
+	}
+
+	// stream each song as it is read from the store
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Minute)
+	defer cancel()
+	count := 0
+	err = songStore.Export(ctx, opts, func(val song) error {
+		var err error
+		if csvWriter != nil {
+			err = csvWriter.Write([]string{val.Id, val.Artist, val.Title, val.Genre})
+		} else {
+			err = encoder.Encode(val)
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushEvery == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if csvWriter != nil {
+		csvWriter.Flush()
+	}
+
+	// the status has already been sent so a failure can only be logged
+	if err != nil {
+		platform.LoggerFor(r.Context()).Warnf("the export stopped after %v songs - %v", count, err)
+		return
+	}
+	platform.LoggerFor(r.Context()).Infof("exported %v songs.", count)
+}
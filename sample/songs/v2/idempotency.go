@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// idempotencyLease is how long a key is held for a request that is still in
+// progress. Completing the request keeps the key for the whole TTL, so a key
+// whose request never finished, such as when the service stopped part way,
+// can be used again soon rather than a day later.
+const idempotencyLease = time.Minute
+
+// leaseExpiry is when a key claimed now is let go if its request doesn't
+// complete; never later than the TTL.
+func leaseExpiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl < idempotencyLease {
+		return now.Add(ttl)
+	}
+	return now.Add(idempotencyLease)
+}
+
+// idempotencyRecord is what is remembered about a request made with an
+// Idempotency-Key; a status of 0 means the request is still in progress.
+type idempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	Fingerprint string    `bson:"fingerprint"`
+	Status      int       `bson:"status"`
+	ContentType string    `bson:"contentType"`
+	Location    string    `bson:"location"`
+	Body        []byte    `bson:"body"`
+	Expires     time.Time `bson:"expires"`
+}
+
+// IdempotencyStore remembers the response to each request made with an
+// Idempotency-Key until the key expires.
+type IdempotencyStore interface {
+	// Begin claims the key for a new request. If the key is already claimed
+	// the existing record is returned instead.
+	Begin(ctx context.Context, key, fingerprint string) (*idempotencyRecord, error)
+
+	// Complete saves the response so that it can be replayed.
+	Complete(ctx context.Context, record idempotencyRecord) error
+
+	// Release forgets the key so that the request can be retried.
+	Release(ctx context.Context, key string) error
+}
+
+// requestFingerprint identifies a request so a key reused for a different request
+// can be detected.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter passes the response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent replays the original response when a request is repeated with
+// the same Idempotency-Key. Requests without the header are passed through.
+func idempotent(keyStore IdempotencyStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeProblem(w, &problem{
+				Type:   "/problems/invalid-idempotency-key",
+				Title:  "the Idempotency-Key is too long.",
+				Status: http.StatusBadRequest,
+			})
+			return
+		}
+
+		// the body is needed for the fingerprint and again by the handler
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			platform.HttpError(w, "the body could not be read.", http.StatusBadRequest)
+			platform.LoggerFor(r.Context()).Warnf("the body could not be read - %v", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := requestFingerprint(r, body)
+
+		// claim the key or find out what happened to the earlier request
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		existing, err := keyStore.Begin(ctx, key, sum)
+		if err != nil {
+			platform.HttpError(w, "the Idempotency-Key could not be checked.", http.StatusInternalServerError)
+			platform.LoggerFor(r.Context()).Errorf("the Idempotency-Key could not be checked - %v", err)
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != sum:
+				writeProblem(w, &problem{
+					Type:   "/problems/idempotency-key-reused",
+					Title:  "the Idempotency-Key was already used for a different request.",
+					Status: http.StatusUnprocessableEntity,
+				})
+			case existing.Status == 0:
+				w.Header().Set("Retry-After", "1")
+				writeProblem(w, &problem{
+					Type:   "/problems/request-in-progress",
+					Title:  "a request with the Idempotency-Key is still in progress.",
+					Status: http.StatusConflict,
+				})
+			default:
+				platform.LoggerFor(r.Context()).Warnf("replaying the response for Idempotency-Key %v.", key)
+				if existing.ContentType != "" {
+					w.Header().Set("Content-Type", existing.ContentType)
+				}
+				if existing.Location != "" {
+					w.Header().Set("Location", existing.Location)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		// handle the request, remembering the response unless it failed in a
+		// way that is worth retrying; this is done even if the caller has gone
+		recorder := &recordingWriter{ResponseWriter: w}
+		next(recorder, r)
+		saveCtx, saveCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer saveCancel()
+		if recorder.status == 0 || recorder.status >= 500 {
+			err = keyStore.Release(saveCtx, key)
+		} else {
+			err = keyStore.Complete(saveCtx, idempotencyRecord{
+				Key:         key,
+				Fingerprint: sum,
+				Status:      recorder.status,
+				ContentType: recorder.Header().Get("Content-Type"),
+				Location:    recorder.Header().Get("Location"),
+				Body:        recorder.body.Bytes(),
+			})
+		}
+		if err != nil {
+			platform.LoggerFor(r.Context()).Errorf("the response for Idempotency-Key %v could not be saved - %v", key, err)
+		}
+	}
+}
+
+// memoryIdempotencyStore keeps the keys in a map; like memoryStore it is meant
+// for a single instance.
+type memoryIdempotencyStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	records   map[string]idempotencyRecord
+	nextSweep time.Time
+}
+
+func newMemoryIdempotencyStore(ttl time.Duration) *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{ttl: ttl, records: map[string]idempotencyRecord{}}
+}
+
+func (s *memoryIdempotencyStore) Begin(ctx context.Context, key, fingerprint string) (*idempotencyRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// drop expired keys every so often rather than on every request
+	now := time.Now()
+	if now.After(s.nextSweep) {
+		for k, record := range s.records {
+			if now.After(record.Expires) {
+				delete(s.records, k)
+			}
+		}
+		s.nextSweep = now.Add(time.Minute)
+	}
+
+	if existing, ok := s.records[key]; ok && now.Before(existing.Expires) {
+		return &existing, nil
+	}
+	s.records[key] = idempotencyRecord{Key: key, Fingerprint: fingerprint, Expires: leaseExpiry(now, s.ttl)}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, record idempotencyRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record.Expires = time.Now().Add(s.ttl)
+	s.records[record.Key] = record
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// mongoIdempotencyStore keeps the keys in their own collection so that every
+// instance of the service sees them; a TTL index removes expired keys.
+type mongoIdempotencyStore struct {
+	collection *mongo.Collection
+	ttl        time.Duration
+}
+
+func newMongoIdempotencyStore(ctx context.Context, collection *mongo.Collection, ttl time.Duration) *mongoIdempotencyStore {
+	// Cosmos DB can only expire documents some time after they were last
+	// written, by _ts, so when the index on expires can't be made one on _ts
+	// is made instead; that expires a key the TTL after its response was
+	// saved. Begin ignores expired keys either way.
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetName("expires").SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		_, tsErr := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "_ts", Value: 1}},
+			Options: options.Index().SetName("ts").SetExpireAfterSeconds(int32(ttl / time.Second)),
+		})
+		if tsErr != nil {
+			platform.LoggerFor(ctx).Errorf("the idempotency expiry index could not be created - %v", err)
+		}
+	}
+	return &mongoIdempotencyStore{collection: collection, ttl: ttl}
+}
+
+func (s *mongoIdempotencyStore) Begin(ctx context.Context, key, fingerprint string) (*idempotencyRecord, error) {
+	now := time.Now()
+	record := idempotencyRecord{Key: key, Fingerprint: fingerprint, Expires: leaseExpiry(now, s.ttl)}
+
+	// the TTL monitor only runs periodically so an expired key may still be
+	// there; it is removed before trying once more
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := s.collection.InsertOne(ctx, record)
+		if err == nil {
+			return nil, nil
+		} else if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		var existing idempotencyRecord
+		err = s.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&existing)
+		if err == mongo.ErrNoDocuments {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if now.Before(existing.Expires) {
+			return &existing, nil
+		}
+		_, err = s.collection.DeleteOne(ctx, bson.M{"_id": key, "expires": existing.Expires})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("the Idempotency-Key could not be claimed")
+}
+
+func (s *mongoIdempotencyStore) Complete(ctx context.Context, record idempotencyRecord) error {
+	record.Expires = time.Now().Add(s.ttl)
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"_id": record.Key}, record)
+	return err
+}
+
+func (s *mongoIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
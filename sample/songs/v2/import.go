@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+const importBatchSize = 500
+const maxImportLineSize = 64 * 1024
+
+type importRow struct {
+	Row        int    `json:"row"`
+	Id         string `json:"id,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ExistingId string `json:"existingId,omitempty"`
+}
+
+type importReport struct {
+	Imported int         `json:"imported"`
+	Failed   int         `json:"failed"`
+	Rows     []importRow `json:"rows"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// importFormat determines whether the body is NDJSON or CSV from its
+// content type.
+func importFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return "ndjson"
+	case "text/csv":
+		return "csv"
+	}
+	return ""
+}
+
+// readImport calls fn with each row of the body, numbered from 1, and the
+// song on it or the reason the row could not be read.
+func readImport(body io.Reader, format string, fn func(row int, val song, err error)) error {
+	if format == "csv" {
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		for row := 1; ; row++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				fn(row, song{}, err)
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			// skip an optional header
+			if row == 1 && strings.EqualFold(strings.Join(record, ","), "artist,title,genre") {
+				continue
+			}
+			if len(record) != 3 {
+				fn(row, song{}, errors.New("the row must have the columns artist,title,genre."))
+				continue
+			}
+			fn(row, song{Artist: record[0], Title: record[1], Genre: record[2]}, nil)
+		}
+	}
+
+	reader := bufio.NewReader(body)
+	for row := 1; ; row++ {
+		line, err := readLine(reader)
+		if err == io.EOF {
+			return nil
+		} else if err == errLineTooLong {
+			fn(row, song{}, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var val song
+		if p := decodeStrict(strings.NewReader(line), &val); p != nil {
+			if len(p.Errors) > 0 {
+				fn(row, val, errors.New(describe(p.Errors)))
+			} else {
+				fn(row, val, errors.New(p.Title))
+			}
+			continue
+		}
+		fn(row, val, nil)
+	}
+}
+
+var errLineTooLong = errors.New("the row is longer than 64KB.")
+
+// readLine reads the next line without its line ending. The rest of a line
+// longer than maxImportLineSize is skipped and errLineTooLong returned so
+// that the row can be reported and the import carry on.
+func readLine(reader *bufio.Reader) (string, error) {
+	line := []byte{}
+	tooLong := false
+	for {
+		chunk, more, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if !tooLong && len(line)+len(chunk) > maxImportLineSize {
+			tooLong = true
+		} else if !tooLong {
+			line = append(line, chunk...)
+		}
+		if !more {
+			break
+		}
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return string(line), nil
+}
+
+func bulkImport(w http.ResponseWriter, r *http.Request, songStore SongStore) {
+	format := importFormat(r.Header.Get("Content-Type"))
+	if format == "" {
+		platform.HttpError(w, "the body must be NDJSON or CSV.", http.StatusUnsupportedMediaType)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	// insert the valid rows in batches as they are read
+	report := importReport{Rows: []importRow{}}
+	batch := []song{}
+	batchRows := []int{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		stored, err := songStore.InsertMany(ctx, batch)
+		rowErrs := RowErrors{}
+		if err != nil && !errors.As(err, &rowErrs) {
+			platform.LoggerFor(r.Context()).Errorf("a batch of %v songs could not be stored - %v", len(batch), err)
+			for i := range batch {
+				rowErrs[i] = errors.New("the song could not be stored.")
+			}
+		}
+		for i := range batch {
+			if rowErr, failed := rowErrs[i]; failed {
+				row := importRow{Row: batchRows[i], Error: rowErr.Error()}
+				var dupErr *DuplicateError
+				if errors.As(rowErr, &dupErr) {
+					row.ExistingId = dupErr.ExistingId
+				}
+				report.Rows = append(report.Rows, row)
+				report.Failed++
+			} else {
+				report.Rows = append(report.Rows, importRow{Row: batchRows[i], Id: stored[i].Id})
+				report.Imported++
+			}
+		}
+		batch = batch[:0]
+		batchRows = batchRows[:0]
+	}
+	err := readImport(r.Body, format, func(row int, val song, err error) {
+		if err == nil {
+			if errs := validateSong(&val); len(errs) > 0 {
+				err = errors.New(describe(errs))
+			}
+		}
+		if err != nil {
+			report.Rows = append(report.Rows, importRow{Row: row, Error: err.Error()})
+			report.Failed++
+			return
+		}
+		batch = append(batch, val)
+		batchRows = append(batchRows, row)
+		if len(batch) >= importBatchSize {
+			flush()
+		}
+	})
+	flush()
+	if err != nil {
+		platform.LoggerFor(r.Context()).Errorf("the import could not be read to the end - %v", err)
+		report.Error = "the rest of the body could not be read."
+	}
+
+	// report each row in the order it appeared
+	sort.SliceStable(report.Rows, func(i, j int) bool {
+		return report.Rows[i].Row < report.Rows[j].Row
+	})
+
+	// write JSON output
+	platform.LoggerFor(r.Context()).Infof("imported %v songs, %v rows failed.", report.Imported, report.Failed)
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		platform.HttpError(w, "the report could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the report could not be marshalled - %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.HttpError(w, "the report could not be written.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the report could not be written - %v", err)
+		return
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultListLimit = 25
+const maxListLimit = 100
+
+type page struct {
+	Items      []song `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// cursor marks the last song of a page by its sort value and id so the next
+// page can resume after it even if songs were added or removed in between.
+type cursor struct {
+	Value string `json:"v"`
+	Id    string `json:"id"`
+}
+
+type listOptions struct {
+	genre      string
+	artist     string
+	limit      int
+	offset     int
+	sortField  string
+	descending bool
+	after      *cursor
+}
+
+func parseListOptions(query url.Values) (listOptions, error) {
+	opts := listOptions{
+		genre:     query.Get("genre"),
+		artist:    query.Get("artist"),
+		limit:     defaultListLimit,
+		sortField: "id",
+	}
+
+	// limit and offset must be sensible numbers
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return opts, errors.New("limit must be a number between 1 and 100.")
+		}
+		opts.limit = limit
+	}
+	if raw := query.Get("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return opts, errors.New("offset must be a positive number.")
+		}
+		opts.offset = offset
+	}
+
+	// sort is a field name, optionally prefixed with "-" for descending
+	if raw := query.Get("sort"); raw != "" {
+		opts.descending = strings.HasPrefix(raw, "-")
+		opts.sortField = strings.TrimPrefix(raw, "-")
+		switch opts.sortField {
+		case "id", "artist", "title", "genre":
+		default:
+			return opts, errors.New("sort must be one of id, artist, title or genre.")
+		}
+	}
+
+	// the cursor is opaque to the client
+	if raw := query.Get("cursor"); raw != "" {
+		after, err := decodeCursor(raw)
+		if err != nil {
+			return opts, errors.New("the cursor is not valid.")
+		}
+		opts.after = &after
+	}
+
+	return opts, nil
+}
+
+func encodeCursor(c cursor) string {
+	bytes, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeCursor(raw string) (cursor, error) {
+	var c cursor
+	bytes, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(bytes, &c)
+	if err != nil {
+		return c, err
+	}
+	_, err = primitive.ObjectIDFromHex(c.Id)
+	return c, err
+}
+
+// sortValue returns the value of the field the list is sorted by.
+func (opts listOptions) sortValue(val song) string {
+	switch opts.sortField {
+	case "artist":
+		return val.Artist
+	case "title":
+		return val.Title
+	case "genre":
+		return val.Genre
+	}
+	return ""
+}
+
+// before reports whether a sorts before b; ties are broken by id so the
+// order is always stable.
+func (opts listOptions) before(aValue string, aId string, bValue string, bId string) bool {
+	if aValue == bValue {
+		if opts.descending {
+			return aId > bId
+		}
+		return aId < bId
+	}
+	if opts.descending {
+		return aValue > bValue
+	}
+	return aValue < bValue
+}
+
+func (opts listOptions) matches(val song) bool {
+	if opts.genre != "" && !strings.EqualFold(val.Genre, opts.genre) {
+		return false
+	}
+	if opts.artist != "" && !strings.EqualFold(val.Artist, opts.artist) {
+		return false
+	}
+	return true
+}
+
+func list(w http.ResponseWriter, r *http.Request, songStore SongStore) {
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		platform.HttpError(w, err.Error(), http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("the list options were not valid - %v", err)
+		return
+	}
+
+	// get the page from the store
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	result, err := songStore.List(ctx, opts)
+	if err != nil {
+		platform.HttpError(w, "the songs could not be retrieved.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the songs could not be retrieved - %v", err)
+		return
+	}
+
+	// write JSON output
+	platform.LoggerFor(r.Context()).Infof("listing %v songs.", len(result.Items))
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		platform.HttpError(w, "the songs could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the songs could not be marshalled - %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.HttpError(w, "the songs could not be written.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the songs could not be written - %v", err)
+		return
+	}
+}
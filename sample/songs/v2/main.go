@@ -3,18 +3,21 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/plasne/aks-lab/sample/platform"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 type song struct {
@@ -24,83 +27,243 @@ type song struct {
 	Genre  string `json:"genre" bson:"genre"`
 }
 
-func retrieve(w http.ResponseWriter, r *http.Request, collection *mongo.Collection) {
+func retrieve(w http.ResponseWriter, r *http.Request, songStore SongStore) {
 	// get a valid id
 	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
 	if err != nil {
-		http.Error(w, "a valid ID was not provided.", http.StatusBadRequest)
-		log.Printf("a valid ID was not provided - %v", err)
+		platform.HttpError(w, "a valid ID was not provided.", http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("a valid ID was not provided - %v", err)
 		return
 	}
 
-	// get the song from the database
-	filter := bson.M{"_id": id}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// get the song from the store
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	var val song
-	err = collection.FindOne(ctx, filter).Decode(&val)
-	if err == mongo.ErrNoDocuments {
-		http.Error(w, "no song with that id was found.", http.StatusNotFound)
-		log.Printf("the song was not found for id %v.", id)
+	val, err := songStore.Get(ctx, id.Hex())
+	if err == ErrNotFound {
+		platform.HttpError(w, "no song with that id was found.", http.StatusNotFound)
+		platform.LoggerFor(r.Context()).Warnf("the song was not found for id %v.", id)
 		return
 	} else if err != nil {
-		http.Error(w, "the song could not be retrieved.", http.StatusInternalServerError)
-		log.Printf("the song could not be retrieved - %v", err)
+		platform.HttpError(w, "the song could not be retrieved.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be retrieved - %v", err)
 		return
 	}
 
 	// write JSON output
-	log.Printf("retrieving song id %v.\n", id)
+	platform.LoggerFor(r.Context()).Infof("retrieving song id %v.", id)
 	bytes, err := json.Marshal(val)
 	if err != nil {
-		http.Error(w, "the song could not be marshalled.", http.StatusInternalServerError)
-		log.Printf("the song could not be marshalled - %v", err)
+		platform.HttpError(w, "the song could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be marshalled - %v", err)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	_, err = w.Write(bytes)
 	if err != nil {
-		http.Error(w, "the song could not be written.", http.StatusInternalServerError)
-		log.Printf("the song could not be written - %v", err)
+		platform.HttpError(w, "the song could not be written.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be written - %v", err)
 		return
 	}
 }
 
-func store(w http.ResponseWriter, r *http.Request, collection *mongo.Collection) {
+func store(w http.ResponseWriter, r *http.Request, songStore SongStore) {
 	// decode the input
 	var val song
-	err := json.NewDecoder(r.Body).Decode(&val)
-	if err != nil {
-		http.Error(w, "the body could not be decoded.", http.StatusBadRequest)
+	if p := decodeStrict(r.Body, &val); p != nil {
+		writeProblem(w, p)
+		return
+	}
+	if errs := validateSong(&val); len(errs) > 0 {
+		writeProblem(w, invalidSong(errs))
 		return
 	}
 
-	// insert into the database
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// insert into the store
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	result, err := collection.InsertOne(ctx, val)
+	val, err := songStore.Insert(ctx, val)
+	var dupErr *DuplicateError
+	if errors.As(err, &dupErr) {
+		writeDuplicate(w, dupErr)
+		platform.LoggerFor(r.Context()).Warnf("the song is a duplicate of %v.", dupErr.ExistingId)
+		return
+	} else if err != nil {
+		platform.HttpError(w, "the song could not be stored.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("failed to add song - %v", err)
+		return
+	}
+
+	// write JSON output
+	platform.LoggerFor(r.Context()).Infof("stored song id %v.", val.Id)
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		platform.HttpError(w, "the song could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be marshalled - %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Location", "/?id="+val.Id)
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.HttpError(w, "the song could not be returned.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be written - %v", err)
+		return
+	}
+}
+
+func update(w http.ResponseWriter, r *http.Request, songStore SongStore) {
+	// get a valid id
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
 	if err != nil {
-		log.Fatalf("failed to add song %v", err)
+		platform.HttpError(w, "a valid ID was not provided.", http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("a valid ID was not provided - %v", err)
+		return
+	}
+
+	// PUT replaces the song, PATCH only sets the fields provided
+	var patch songPatch
+	if r.Method == "PATCH" {
+		if p := decodeStrict(r.Body, &patch); p != nil {
+			writeProblem(w, p)
+			return
+		}
+		if patch.isEmpty() {
+			platform.HttpError(w, "no fields were provided to update.", http.StatusBadRequest)
+			return
+		}
+		if errs := validatePatch(&patch); len(errs) > 0 {
+			writeProblem(w, invalidSong(errs))
+			return
+		}
+	} else {
+		var val song
+		if p := decodeStrict(r.Body, &val); p != nil {
+			writeProblem(w, p)
+			return
+		}
+		if errs := validateSong(&val); len(errs) > 0 {
+			writeProblem(w, invalidSong(errs))
+			return
+		}
+		patch = replacement(val)
+	}
+
+	// update the store
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	val, err := songStore.Update(ctx, id.Hex(), patch)
+	var dupErr *DuplicateError
+	if err == ErrNotFound {
+		platform.HttpError(w, "no song with that id was found.", http.StatusNotFound)
+		platform.LoggerFor(r.Context()).Warnf("the song was not found for id %v.", id)
+		return
+	} else if errors.As(err, &dupErr) {
+		writeDuplicate(w, dupErr)
+		platform.LoggerFor(r.Context()).Warnf("the update would duplicate %v.", dupErr.ExistingId)
+		return
+	} else if err != nil {
+		platform.HttpError(w, "the song could not be updated.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be updated - %v", err)
+		return
 	}
-	val.Id = result.InsertedID.(primitive.ObjectID).Hex()
 
 	// write JSON output
-	log.Printf("stored song id %v.\n", val.Id)
+	platform.LoggerFor(r.Context()).Infof("updated song id %v.", id)
 	bytes, err := json.Marshal(val)
 	if err != nil {
-		http.Error(w, "the song could not be marshalled.", http.StatusInternalServerError)
-		log.Printf("the song could not be marshalled - %v", err)
+		platform.HttpError(w, "the song could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be marshalled - %v", err)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	_, err = w.Write(bytes)
 	if err != nil {
-		http.Error(w, "the song could not be returned.", http.StatusInternalServerError)
-		log.Printf("the song could not be written - %v", err)
+		platform.HttpError(w, "the song could not be returned.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be written - %v", err)
 		return
 	}
 }
 
+func remove(w http.ResponseWriter, r *http.Request, songStore SongStore) {
+	// get a valid id
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		platform.HttpError(w, "a valid ID was not provided.", http.StatusBadRequest)
+		platform.LoggerFor(r.Context()).Warnf("a valid ID was not provided - %v", err)
+		return
+	}
+
+	// delete from the store
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	err = songStore.Delete(ctx, id.Hex())
+	if err == ErrNotFound {
+		platform.HttpError(w, "no song with that id was found.", http.StatusNotFound)
+		platform.LoggerFor(r.Context()).Warnf("the song was not found for id %v.", id)
+		return
+	} else if err != nil {
+		platform.HttpError(w, "the song could not be deleted.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the song could not be deleted - %v", err)
+		return
+	}
+
+	platform.LoggerFor(r.Context()).Infof("deleted song id %v.", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newHandler routes requests to the handlers for the store.
+func newHandler(songStore SongStore, keyStore IdempotencyStore) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if r.URL.Query().Get("id") == "" {
+				list(w, r, songStore)
+			} else {
+				retrieve(w, r, songStore)
+			}
+		case "POST":
+			idempotent(keyStore, func(w http.ResponseWriter, r *http.Request) {
+				store(w, r, songStore)
+			})(w, r)
+		case "PUT", "PATCH":
+			update(w, r, songStore)
+		case "DELETE":
+			remove(w, r, songStore)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			bulkImport(w, r, songStore)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			export(w, r, songStore)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			search(w, r, songStore)
+		default:
+			platform.HttpError(w, "the method is not implemented.", http.StatusNotImplemented)
+		}
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
 func EnvOrString(key, def string) string {
 	val := os.Getenv(key)
 	if val == "" {
@@ -120,58 +283,90 @@ func EnvOrInt(key string, def int) int {
 func main() {
 	// determine configuration
 	godotenv.Load()
-	port := EnvOrInt("PORT", 80)
-	mongoConnString := EnvOrString("MONGO_CONNSTRING", "")
-	if mongoConnString == "" {
-		log.Fatal("You must provide MONGO_CONNSTRING.")
-	}
-	mongoDatabase := EnvOrString("MONGO_DATABASE", "db")
-	mongoCollection := EnvOrString("MONGO_COLLECTION", "col")
-	log.Printf("PORT = %v", port)
-	log.Print("MONGO_CONNSTRING = *SET*")
-	log.Printf("MONGO_DATABASE = %v", mongoDatabase)
-	log.Printf("MONGO_COLLECTION = %v", mongoCollection)
-
-	// attempt to initialize Cosmos connection
-	log.Printf("attempting to initialize Cosmos connection...")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoConnString))
+	if err := platform.SetupLogging("songs"); err != nil {
+		platform.ServiceLog.Fatalf("unable to set up logging - %v", err)
+	}
+	shutdown, err := platform.SetupTracing(context.Background(), "songs")
 	if err != nil {
-		log.Fatalf("unable to initialize Cosmos connection - %v", err)
+		platform.ServiceLog.Fatalf("unable to set up tracing - %v", err)
 	}
-	defer func() {
-		if err = client.Disconnect(ctx); err != nil {
-			panic(err)
+	defer shutdown(context.Background())
+	loadAllowedGenres()
+	port := EnvOrInt("PORT", 80)
+	// v2 has always kept songs in Mongo, so that is the default; memory is for
+	// running without a database
+	storeBackend := EnvOrString("STORE_BACKEND", "mongo")
+	idempotencyTtl := time.Duration(EnvOrInt("IDEMPOTENCY_TTL", 86400)) * time.Second
+	requestTimeout := time.Duration(EnvOrInt("REQUEST_TIMEOUT_MS", 0)) * time.Millisecond
+	platform.ServiceLog.Infof("PORT = %v", port)
+	platform.ServiceLog.Infof("STORE_BACKEND = %v", storeBackend)
+	platform.ServiceLog.Infof("IDEMPOTENCY_TTL = %v", idempotencyTtl)
+	platform.ServiceLog.Infof("REQUEST_TIMEOUT_MS = %v", requestTimeout)
+	platform.ServiceLog.Infof("ALLOWED_GENRES = %v", strings.Join(allowedGenres, ","))
+
+	// create the store
+	var songStore SongStore
+	var keyStore IdempotencyStore
+	switch storeBackend {
+	case "memory":
+		songStore = newMemoryStore()
+		keyStore = newMemoryIdempotencyStore(idempotencyTtl)
+	case "mongo":
+		mongoConnString := EnvOrString("MONGO_CONNSTRING", "")
+		if mongoConnString == "" {
+			platform.ServiceLog.Fatalf("You must provide MONGO_CONNSTRING.")
 		}
-	}()
-	log.Printf("successfully initialized Cosmos connection.")
+		mongoDatabase := EnvOrString("MONGO_DATABASE", "db")
+		mongoCollection := EnvOrString("MONGO_COLLECTION", "col")
+		mongoIdempotencyCollection := EnvOrString("MONGO_IDEMPOTENCY_COLLECTION", "idempotency")
+		platform.ServiceLog.Infof("MONGO_CONNSTRING = *SET*")
+		platform.ServiceLog.Infof("MONGO_DATABASE = %v", mongoDatabase)
+		platform.ServiceLog.Infof("MONGO_COLLECTION = %v", mongoCollection)
+		platform.ServiceLog.Infof("MONGO_IDEMPOTENCY_COLLECTION = %v", mongoIdempotencyCollection)
 
-	// attempt to connect to a Cosmos instance
-	log.Printf("attempting to connect to Cosmos...")
-	pingCtx, pingCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	err = client.Ping(pingCtx, nil)
-	if err != nil {
-		log.Fatalf("unable to connect to Cosmos - %v", err)
-	}
-	pingCancel()
-	log.Println("successfully connected to Cosmos.")
-	collection := client.Database(mongoDatabase).Collection(mongoCollection)
+		// attempt to initialize Cosmos connection
+		platform.ServiceLog.Infof("attempting to initialize Cosmos connection...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoConnString).SetMonitor(measuredMonitor(otelmongo.NewMonitor())))
+		if err != nil {
+			platform.ServiceLog.Fatalf("unable to initialize Cosmos connection - %v", err)
+		}
+		defer func() {
+			if err = client.Disconnect(ctx); err != nil {
+				panic(err)
+			}
+		}()
+		platform.ServiceLog.Infof("successfully initialized Cosmos connection.")
 
-	// create HTTP handlers
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			retrieve(w, r, collection)
-		case "POST":
-			store(w, r, collection)
-		default:
-			http.Error(w, "the method is not implemented.", http.StatusNotImplemented)
+		// attempt to connect to a Cosmos instance
+		platform.ServiceLog.Infof("attempting to connect to Cosmos...")
+		pingCtx, pingCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = client.Ping(pingCtx, nil)
+		if err != nil {
+			platform.ServiceLog.Fatalf("unable to connect to Cosmos - %v", err)
 		}
-	})
+		pingCancel()
+		platform.ServiceLog.Infof("successfully connected to Cosmos.")
+
+		// the indexes are built, and songs stored before them updated, before
+		// taking requests; that can take a while on a large catalog so it isn't
+		// held to the time allowed to connect
+		indexCtx, indexCancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		songStore, err = newMongoStore(indexCtx, client.Database(mongoDatabase).Collection(mongoCollection))
+		if err != nil {
+			platform.ServiceLog.Fatalf("unable to prepare the songs collection - %v", err)
+		}
+		indexCancel()
+		keyStore = newMongoIdempotencyStore(ctx, client.Database(mongoDatabase).Collection(mongoIdempotencyCollection), idempotencyTtl)
+	default:
+		platform.ServiceLog.Fatalf("STORE_BACKEND must be either mongo or memory, not %v.", storeBackend)
+	}
 
 	// start listening for incoming connections
-	log.Printf("listening on port %v...", port)
-	err = http.ListenAndServe(fmt.Sprint(":", port), nil)
-	log.Fatal(err)
+	platform.ServiceLog.Infof("listening on port %v...", port)
+	mux := newHandler(songStore, keyStore)
+	handler := platform.WithDeadline(requestTimeout, mux)
+	err = http.ListenAndServe(fmt.Sprint(":", port), platform.Traced("songs", platform.WithRequestId(platform.Measured(mux, apiVersion, handler))))
+	platform.ServiceLog.Fatalf("%v", err)
 }
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/plasne/aks-lab/sample/platform"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMain(m *testing.M) {
+	platform.LogOutput = io.Discard
+	os.Exit(m.Run())
+}
+
+// do sends a request to a handler backed by the store and returns the response.
+func do(t *testing.T, songStore SongStore, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	newHandler(songStore, newMemoryIdempotencyStore(time.Hour)).ServeHTTP(w, req)
+	return w
+}
+
+// insert stores a song through the handler and returns it with its new id.
+func insert(t *testing.T, songStore SongStore, artist, title, genre string) song {
+	t.Helper()
+	body, _ := json.Marshal(song{Artist: artist, Title: title, Genre: genre})
+	w := do(t, songStore, "POST", "/", string(body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 storing a song, got %v: %v", w.Code, w.Body.String())
+	}
+	var val song
+	if err := json.Unmarshal(w.Body.Bytes(), &val); err != nil {
+		t.Fatalf("the stored song could not be decoded - %v", err)
+	}
+	if location := w.Header().Get("Location"); location != "/?id="+val.Id {
+		t.Fatalf("expected the Location of the new song, got %v", location)
+	}
+	return val
+}
+
+func TestStoreAndRetrieve(t *testing.T) {
+	songStore := newMemoryStore()
+	stored := insert(t, songStore, "Eminem", "The Ringer", "Rap")
+	if stored.Id == "" {
+		t.Fatal("expected the stored song to have an id")
+	}
+
+	w := do(t, songStore, "GET", "/?id="+stored.Id, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", w.Code)
+	}
+	var val song
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val != stored {
+		t.Fatalf("expected %+v, got %+v", stored, val)
+	}
+}
+
+func TestRetrieveErrors(t *testing.T) {
+	songStore := newMemoryStore()
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/?id=not-an-id", http.StatusBadRequest},
+		{"/?id=0123456789abcdef01234567", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := do(t, songStore, "GET", test.target, "")
+		if w.Code != test.code {
+			t.Errorf("GET %v: expected %v, got %v", test.target, test.code, w.Code)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	songStore := newMemoryStore()
+	stored := insert(t, songStore, "Drake", "In My Feelings", "HipHop")
+
+	// PATCH only changes the fields provided
+	w := do(t, songStore, "PATCH", "/?id="+stored.Id, `{"title":"In My Feelings (Remix)"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", w.Code)
+	}
+	var val song
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val.Title != "In My Feelings (Remix)" || val.Artist != "Drake" || val.Genre != "HipHop" {
+		t.Fatalf("unexpected song after PATCH %+v", val)
+	}
+
+	// PUT replaces every field
+	w = do(t, songStore, "PUT", "/?id="+stored.Id, `{"artist":"Drake","title":"Nonstop"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", w.Code)
+	}
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val.Title != "Nonstop" || val.Genre != "" || val.Id != stored.Id {
+		t.Fatalf("unexpected song after PUT %+v", val)
+	}
+
+	w = do(t, songStore, "PATCH", "/?id=0123456789abcdef01234567", `{"title":"x"}`)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown id, got %v", w.Code)
+	}
+	w = do(t, songStore, "PATCH", "/?id="+stored.Id, `{}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty patch, got %v", w.Code)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	songStore := newMemoryStore()
+	stored := insert(t, songStore, "Weezer", "Africa", "Rock")
+
+	w := do(t, songStore, "DELETE", "/?id="+stored.Id, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %v", w.Code)
+	}
+	w = do(t, songStore, "GET", "/?id="+stored.Id, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %v", w.Code)
+	}
+	w = do(t, songStore, "DELETE", "/?id="+stored.Id, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 deleting twice, got %v", w.Code)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	songStore := newMemoryStore()
+	insert(t, songStore, "Eminem", "Lucky You", "Rap")
+	insert(t, songStore, "Weezer", "Africa", "Rock")
+	insert(t, songStore, "Eminem", "The Ringer", "Rap")
+	insert(t, songStore, "Drake", "In My Feelings", "HipHop")
+	insert(t, songStore, "Nicki Minaj", "Barbie Dreams", "rap")
+
+	// walk every page of rap songs sorted by title
+	titles := []string{}
+	target := "/?genre=Rap&sort=title&limit=2"
+	for pages := 0; target != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		w := do(t, songStore, "GET", target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+		}
+		var result page
+		json.Unmarshal(w.Body.Bytes(), &result)
+		for _, x := range result.Items {
+			titles = append(titles, x.Title)
+		}
+		target = ""
+		if result.NextCursor != "" {
+			target = "/?genre=Rap&sort=title&limit=2&cursor=" + result.NextCursor
+		}
+	}
+	expected := "Barbie Dreams,Lucky You,The Ringer"
+	if strings.Join(titles, ",") != expected {
+		t.Fatalf("expected %v, got %v", expected, strings.Join(titles, ","))
+	}
+
+	w := do(t, songStore, "GET", "/?sort=length", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown sort, got %v", w.Code)
+	}
+}
+
+func TestMongoFilter(t *testing.T) {
+	// the filters compare the lowercase fields so that they can use an index
+	filter := mongoFilter(listOptions{artist: "EMINEM", genre: "Rap"})
+	if filter["artistLower"] != "eminem" || filter["genreLower"] != "rap" || len(filter) != 2 {
+		t.Fatalf("expected equality on the lowercase fields, got %v", filter)
+	}
+	doc := newSongDocument(primitive.NewObjectID(), song{Artist: "Eminem", Title: "The Ringer", Genre: "Rap"})
+	if doc.ArtistLower != "eminem" || doc.GenreLower != "rap" {
+		t.Fatalf("expected the lowercase fields to be stored, got %+v", doc)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	songStore := newMemoryStore()
+	insert(t, songStore, "Drake", "In My Feelings", "HipHop")
+	insert(t, songStore, "Khalid & Normani", "Love Lies", "HipHop")
+	lies := insert(t, songStore, "Ed Sheeran", "Lies", "Pop")
+	insert(t, songStore, "Weezer", "Africa", "Rock")
+
+	// only the songs with lies in the title are found
+	w := do(t, songStore, "GET", "/search?q=lies", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", w.Code)
+	}
+	var result struct {
+		Items []struct {
+			Id    string  `json:"id"`
+			Title string  `json:"title"`
+			Score float64 `json:"score"`
+		} `json:"items"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 2 {
+		t.Fatalf("expected 2 results, got %v", len(result.Items))
+	}
+
+	// matching more of the query ranks higher
+	w = do(t, songStore, "GET", "/search?q=ed+lies", "")
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 2 || result.Items[0].Id != lies.Id {
+		t.Fatalf("expected %v to rank first, got %+v", lies.Title, result.Items)
+	}
+
+	// the index follows updates and deletes
+	do(t, songStore, "PATCH", "/?id="+lies.Id, `{"title":"Perfect"}`)
+	w = do(t, songStore, "GET", "/search?q=perfect", "")
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 1 {
+		t.Fatalf("expected the updated title to be found, got %+v", result.Items)
+	}
+	do(t, songStore, "DELETE", "/?id="+lies.Id, "")
+	w = do(t, songStore, "GET", "/search?q=perfect", "")
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 0 {
+		t.Fatalf("expected the deleted song to be gone, got %+v", result.Items)
+	}
+
+	w = do(t, songStore, "GET", "/search", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a query, got %v", w.Code)
+	}
+}
+
+func TestBulkImport(t *testing.T) {
+	songStore := newMemoryStore()
+	tests := []struct {
+		contentType string
+		body        string
+		imported    int
+		failed      int
+	}{
+		{"text/csv", "artist,title,genre\nOh Hellos,Boreas,Folk\n,No Artist,Pop\nA,B\n", 1, 2},
+		{"application/x-ndjson", "{\"artist\":\"A\",\"title\":\"B\"}\n\nnot json\n{\"artist\":\"C\"}\n", 1, 2},
+		{"application/x-ndjson", "{\"artist\":\"" + strings.Repeat("x", maxImportLineSize) + "\"}\n{\"artist\":\"Khalid\",\"title\":\"Talk\",\"genre\":\"Pop\"}\n", 1, 1},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/import", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		newHandler(songStore, newMemoryIdempotencyStore(time.Hour)).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %v", test.contentType, w.Code)
+		}
+		var report importReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		if report.Imported != test.imported || report.Failed != test.failed {
+			t.Errorf("%v: expected %v imported and %v failed, got %+v", test.contentType, test.imported, test.failed, report)
+		}
+		for _, row := range report.Rows {
+			if row.Error == "" && row.Id == "" {
+				t.Errorf("%v: row %v was imported without an id", test.contentType, row.Row)
+			}
+		}
+	}
+
+	w := do(t, songStore, "GET", "/?limit=10", "")
+	var result page
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Items) != 3 {
+		t.Fatalf("expected 3 imported songs, got %v", len(result.Items))
+	}
+
+	w = do(t, songStore, "POST", "/import", "")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 without a content type, got %v", w.Code)
+	}
+}
+
+func TestExport(t *testing.T) {
+	songStore := newMemoryStore()
+	insert(t, songStore, "Eminem", "Lucky You", "Rap")
+	insert(t, songStore, "Weezer", "Africa", "Rock")
+	insert(t, songStore, "Eminem", "The Ringer", "Rap")
+
+	tests := []struct {
+		accept      string
+		contentType string
+		lines       int
+	}{
+		{"", "application/x-ndjson", 2},
+		{"text/csv", "text/csv", 3},
+		{"application/xml, text/csv;q=0.5", "text/csv", 3},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/export?artist=eminem&sort=-title", nil)
+		req.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		newHandler(songStore, newMemoryIdempotencyStore(time.Hour)).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %v", test.accept, w.Code)
+		}
+		if w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%v: expected %v, got %v", test.accept, test.contentType, w.Header().Get("Content-Type"))
+		}
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if len(lines) != test.lines {
+			t.Errorf("%v: expected %v lines, got %v", test.accept, test.lines, len(lines))
+		}
+		if !strings.Contains(lines[len(lines)-1], "Lucky You") {
+			t.Errorf("%v: expected Lucky You last, got %v", test.accept, lines[len(lines)-1])
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/export", nil)
+	req.Header.Set("Accept", "application/xml")
+	w := httptest.NewRecorder()
+	newHandler(songStore, newMemoryIdempotencyStore(time.Hour)).ServeHTTP(w, req)
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("expected 406 for xml, got %v", w.Code)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	os.Setenv("ALLOWED_GENRES", "HipHop,Pop")
+	loadAllowedGenres()
+	defer func() {
+		os.Unsetenv("ALLOWED_GENRES")
+		loadAllowedGenres()
+	}()
+	songStore := newMemoryStore()
+	tests := []struct {
+		body   string
+		fields []string
+	}{
+		{`{"artist":"","title":"  "}`, []string{"artist", "title"}},
+		{`{"artist":"Drake","title":"` + strings.Repeat("x", 201) + `"}`, []string{"title"}},
+		{`{"artist":"Drake","title":"Nonstop","genre":"Polka"}`, []string{"genre"}},
+		{`{"artist":"Drake","title":"Nonstop","year":2018}`, []string{"year"}},
+		{`{"artist":42,"title":"Nonstop"}`, []string{"artist"}},
+	}
+	for _, test := range tests {
+		w := do(t, songStore, "POST", "/", test.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %v", test.body, w.Code)
+			continue
+		}
+		if w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("%v: expected a problem, got %v", test.body, w.Header().Get("Content-Type"))
+		}
+		var p problem
+		json.Unmarshal(w.Body.Bytes(), &p)
+		fields := []string{}
+		for _, e := range p.Errors {
+			fields = append(fields, e.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") {
+			t.Errorf("%v: expected errors for %v, got %+v", test.body, test.fields, p.Errors)
+		}
+	}
+
+	// the genre is stored with the configured spelling
+	stored := insert(t, songStore, "Drake", "Nonstop", "hiphop")
+	if stored.Genre != "HipHop" {
+		t.Fatalf("expected the genre HipHop, got %v", stored.Genre)
+	}
+	w := do(t, songStore, "PATCH", "/?id="+stored.Id, `{"title":""}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 blanking the title, got %v", w.Code)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	songStore := newMemoryStore()
+	original := insert(t, songStore, "Khalid & Normani", "Love Lies", "HipHop")
+	other := insert(t, songStore, "Drake", "In My Feelings", "HipHop")
+
+	// case and whitespace don't make a song different
+	w := do(t, songStore, "POST", "/", `{"artist":"khalid  &  normani","title":"LOVE LIES"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %v", w.Code)
+	}
+	var p problem
+	json.Unmarshal(w.Body.Bytes(), &p)
+	if p.ExistingId != original.Id {
+		t.Fatalf("expected the existing id %v, got %v", original.Id, p.ExistingId)
+	}
+
+	// an update can't turn one song into a copy of another
+	w = do(t, songStore, "PATCH", "/?id="+other.Id, `{"artist":"Khalid & Normani","title":"Love Lies"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 updating into a duplicate, got %v", w.Code)
+	}
+	w = do(t, songStore, "PATCH", "/?id="+original.Id, `{"genre":"Pop"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 updating a song in place, got %v", w.Code)
+	}
+
+	// once deleted, the song can be stored again
+	do(t, songStore, "DELETE", "/?id="+original.Id, "")
+	insert(t, songStore, "Khalid & Normani", "Love Lies", "HipHop")
+
+	// duplicates within an import and against the store are reported per row
+	req := httptest.NewRequest("POST", "/import", strings.NewReader("Drake,In My Feelings,HipHop\nWeezer,Africa,Rock\nweezer,africa,Rock\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	w = httptest.NewRecorder()
+	newHandler(songStore, newMemoryIdempotencyStore(time.Hour)).ServeHTTP(w, req)
+	var report importReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Imported != 1 || report.Failed != 2 || report.Rows[0].ExistingId != other.Id {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	songStore := newMemoryStore()
+	handler := newHandler(songStore, newMemoryIdempotencyStore(time.Hour))
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// a retry gets the original response and doesn't store the song again
+	first := post("abc", `{"artist":"Tyga","title":"Taste"}`)
+	second := post("abc", `{"artist":"Tyga","title":"Taste"}`)
+	if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+		t.Fatalf("expected 201 twice, got %v and %v", first.Code, second.Code)
+	}
+	if second.Header().Get("Location") != first.Header().Get("Location") {
+		t.Fatalf("expected the Location to be replayed, got %v", second.Header().Get("Location"))
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected the first response to be replayed, got %v", second.Body.String())
+	}
+
+	// the same key with a different body is rejected
+	w := post("abc", `{"artist":"Tyga","title":"Dip"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %v", w.Code)
+	}
+
+	// a client error is replayed too, but a new key goes through
+	w = post("def", `{"artist":""}`)
+	if w.Code != http.StatusBadRequest || post("def", `{"artist":""}`).Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 to be replayed, got %v", w.Code)
+	}
+	if w = post("ghi", `{"artist":"Tyga","title":"Dip"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 with a new key, got %v", w.Code)
+	}
+	page, _ := songStore.List(context.Background(), listOptions{limit: 10, sortField: "id"})
+	if len(page.Items) != 2 {
+		t.Fatalf("expected 2 songs, got %v", len(page.Items))
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	keyStore := newMemoryIdempotencyStore(-time.Second)
+	ctx := context.Background()
+	keyStore.Begin(ctx, "abc", "one")
+	if existing, _ := keyStore.Begin(ctx, "abc", "two"); existing != nil {
+		t.Fatal("expected an expired key to be claimed again")
+	}
+}
+
+func TestIdempotencyLease(t *testing.T) {
+	// a key is only held briefly until its request completes
+	keyStore := newMemoryIdempotencyStore(time.Hour)
+	ctx := context.Background()
+	keyStore.Begin(ctx, "abc", "one")
+	if remaining := time.Until(keyStore.records["abc"].Expires); remaining > idempotencyLease {
+		t.Fatalf("expected the key to be leased for %v, got %v", idempotencyLease, remaining)
+	}
+	keyStore.Complete(ctx, idempotencyRecord{Key: "abc", Fingerprint: "one", Status: http.StatusCreated})
+	if remaining := time.Until(keyStore.records["abc"].Expires); remaining <= idempotencyLease {
+		t.Fatalf("expected the completed key to be kept for the TTL, got %v", remaining)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	mux := newHandler(newMemoryStore(), newMemoryIdempotencyStore(time.Hour))
+	handler := platform.Measured(mux, apiVersion, mux)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?id=not-an-id", nil))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v", w.Code)
+	}
+	expected := `http_requests_total{api_version="v2",method="GET",route="/",status="400"} 1`
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Fatalf("expected the metrics to contain %v", expected)
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	handler := platform.WithRequestId(newHandler(newMemoryStore(), newMemoryIdempotencyStore(time.Hour)))
+
+	// an id from the caller is kept and returned on the error
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"artist": ""}`))
+	req.Header.Set(platform.RequestIdHeader, "abc-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if id := w.Header().Get(platform.RequestIdHeader); id != "abc-123" {
+		t.Fatalf("expected the caller's request id, got %v", id)
+	}
+	var val problem
+	json.Unmarshal(w.Body.Bytes(), &val)
+	if val.RequestId != "abc-123" {
+		t.Fatalf("expected the request id in the problem, got %+v", val)
+	}
+
+	// one is made up for requests without a usable id
+	req = httptest.NewRequest("GET", "/?id=not-an-id", nil)
+	req.Header.Set(platform.RequestIdHeader, "not a valid id")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	id := w.Header().Get(platform.RequestIdHeader)
+	if id == "" || id == "not a valid id" {
+		t.Fatalf("expected a new request id, got %q", id)
+	}
+	if !strings.Contains(w.Body.String(), id) {
+		t.Fatalf("expected the request id in the error, got %v", w.Body.String())
+	}
+}
+
+func TestExportFlushesThroughMiddleware(t *testing.T) {
+	songStore := newMemoryStore()
+	rows := []string{}
+	for i := 0; i < exportFlushEvery; i++ {
+		rows = append(rows, fmt.Sprintf("Artist %v,Title %v,Pop", i, i))
+	}
+	req := httptest.NewRequest("POST", "/import", strings.NewReader(strings.Join(rows, "\n")))
+	req.Header.Set("Content-Type", "text/csv")
+	newHandler(songStore, newMemoryIdempotencyStore(time.Hour)).ServeHTTP(httptest.NewRecorder(), req)
+
+	// the export is streamed through the same middleware as in main
+	mux := newHandler(songStore, newMemoryIdempotencyStore(time.Hour))
+	handler := platform.Traced("songs", platform.WithRequestId(platform.Measured(mux, apiVersion, platform.WithDeadline(0, mux))))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/export", nil))
+	if w.Code != http.StatusOK || !w.Flushed {
+		t.Fatalf("expected the export to be flushed, got %v flushed %v", w.Code, w.Flushed)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryStore keeps songs in a map; it is meant for local development and
+// tests where there is no Cosmos instance.
+type memoryStore struct {
+	mutex sync.RWMutex
+	songs map[string]song
+	keys  map[string]string
+	index *searchIndex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{songs: map[string]song{}, keys: map[string]string{}, index: newSearchIndex()}
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (song, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	val, ok := s.songs[id]
+	if !ok {
+		return val, ErrNotFound
+	}
+	return val, nil
+}
+
+// add stores a new song unless it is a duplicate. The caller must hold the
+// mutex.
+func (s *memoryStore) add(val song) (song, error) {
+	key := songKey(val)
+	if existing, ok := s.keys[key]; ok {
+		return val, &DuplicateError{ExistingId: existing}
+	}
+	val.Id = primitive.NewObjectID().Hex()
+	s.songs[val.Id] = val
+	s.keys[key] = val.Id
+	s.index.add(val)
+	return val, nil
+}
+
+func (s *memoryStore) Insert(ctx context.Context, val song) (song, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.add(val)
+}
+
+func (s *memoryStore) InsertMany(ctx context.Context, vals []song) ([]song, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored := make([]song, len(vals))
+	rowErrs := RowErrors{}
+	for i, val := range vals {
+		var err error
+		stored[i], err = s.add(val)
+		if err != nil {
+			rowErrs[i] = err
+		}
+	}
+	if len(rowErrs) > 0 {
+		return stored, rowErrs
+	}
+	return stored, nil
+}
+
+func (s *memoryStore) List(ctx context.Context, opts listOptions) (page, error) {
+	s.mutex.RLock()
+	matched := []song{}
+	for _, x := range s.songs {
+		if opts.matches(x) {
+			matched = append(matched, x)
+		}
+	}
+	s.mutex.RUnlock()
+
+	// sort into a stable order
+	sort.Slice(matched, func(i, j int) bool {
+		return opts.before(opts.sortValue(matched[i]), matched[i].Id, opts.sortValue(matched[j]), matched[j].Id)
+	})
+
+	// resume after the cursor, then apply the offset and limit
+	start := 0
+	if opts.after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return opts.before(opts.after.Value, opts.after.Id, opts.sortValue(matched[i]), matched[i].Id)
+		})
+	}
+	start += opts.offset
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := start + opts.limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	result := page{Items: matched[start:end]}
+	if end < len(matched) {
+		last := matched[end-1]
+		result.NextCursor = encodeCursor(cursor{Value: opts.sortValue(last), Id: last.Id})
+	}
+	return result, nil
+}
+
+func (s *memoryStore) Export(ctx context.Context, opts listOptions, fn func(val song) error) error {
+	s.mutex.RLock()
+	matched := []song{}
+	for _, x := range s.songs {
+		if opts.matches(x) {
+			matched = append(matched, x)
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return opts.before(opts.sortValue(matched[i]), matched[i].Id, opts.sortValue(matched[j]), matched[j].Id)
+	})
+	for _, x := range matched {
+		if err := fn(x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, id string, patch songPatch) (song, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.songs[id]
+	if !ok {
+		return val, ErrNotFound
+	}
+	oldKey := songKey(val)
+	patch.apply(&val)
+	key := songKey(val)
+	if existing, ok := s.keys[key]; ok && existing != id {
+		return val, &DuplicateError{ExistingId: existing}
+	}
+	delete(s.keys, oldKey)
+	s.keys[key] = id
+	s.songs[id] = val
+	s.index.remove(id)
+	s.index.add(val)
+	return val, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	val, ok := s.songs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.keys, songKey(val))
+	delete(s.songs, id)
+	s.index.remove(id)
+	return nil
+}
+
+func (s *memoryStore) Search(ctx context.Context, query string, limit int) ([]searchHit, error) {
+	s.mutex.RLock()
+	hits := []searchHit{}
+	for id, score := range s.index.search(query, len(s.songs)) {
+		hits = append(hits, searchHit{song: s.songs[id], Score: score})
+	}
+	s.mutex.RUnlock()
+
+	rank(hits)
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	mongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "mongo_command_duration_seconds",
+		Help:        "How long Mongo commands took, by command and whether they succeeded.",
+		Buckets:     prometheus.DefBuckets,
+		ConstLabels: prometheus.Labels{"api_version": apiVersion},
+	}, []string{"command", "status"})
+)
+
+// apiVersion is the x-api-version this service answers to. Every metric is
+// labelled with it so the versions can be compared during a canary.
+const apiVersion = "v2"
+
+// measuredMonitor times every Mongo command before passing the events on to
+// next.
+func measuredMonitor(next *event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			if next.Started != nil {
+				next.Started(ctx, evt)
+			}
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			mongoCommandDuration.WithLabelValues(evt.CommandName, "succeeded").Observe(time.Duration(evt.DurationNanos).Seconds())
+			if next.Succeeded != nil {
+				next.Succeeded(ctx, evt)
+			}
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			mongoCommandDuration.WithLabelValues(evt.CommandName, "failed").Observe(time.Duration(evt.DurationNanos).Seconds())
+			if next.Failed != nil {
+				next.Failed(ctx, evt)
+			}
+		},
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/plasne/aks-lab/sample/platform"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoStore struct {
+	collection *mongo.Collection
+	textSearch bool
+}
+
+// songDocument is how a song is written to Mongo; key holds the normalised
+// artist and title that the unique index is built on, and the lowercase
+// artist and genre let the list filters match on an index.
+type songDocument struct {
+	Id          primitive.ObjectID `bson:"_id"`
+	Artist      string             `bson:"artist"`
+	Title       string             `bson:"title"`
+	Genre       string             `bson:"genre"`
+	Key         string             `bson:"key"`
+	ArtistLower string             `bson:"artistLower"`
+	GenreLower  string             `bson:"genreLower"`
+}
+
+func newSongDocument(id primitive.ObjectID, val song) songDocument {
+	return songDocument{
+		Id:          id,
+		Artist:      val.Artist,
+		Title:       val.Title,
+		Genre:       val.Genre,
+		Key:         songKey(val),
+		ArtistLower: strings.ToLower(val.Artist),
+		GenreLower:  strings.ToLower(val.Genre),
+	}
+}
+
+// newMongoStore builds the indexes the store needs and brings songs stored
+// before them up to date, failing if it can't.
+func newMongoStore(ctx context.Context, collection *mongo.Collection) (*mongoStore, error) {
+	store := &mongoStore{collection: collection}
+	err := store.ensureIndexes(ctx)
+	return store, err
+}
+
+// ensureIndexes creates the indexes that back each supported sort order and
+// filter, the search and the detection of duplicates.
+func (s *mongoStore) ensureIndexes(ctx context.Context) error {
+	models := []mongo.IndexModel{}
+	for _, field := range []string{"artist", "title", "genre"} {
+		models = append(models, mongo.IndexModel{Keys: bson.D{{Key: field, Value: 1}, {Key: "_id", Value: 1}}})
+	}
+	for _, field := range []string{"artistLower", "genreLower"} {
+		models = append(models, mongo.IndexModel{Keys: bson.D{{Key: field, Value: 1}, {Key: "_id", Value: 1}}})
+	}
+	_, err := s.collection.Indexes().CreateMany(ctx, models)
+	if err != nil {
+		return fmt.Errorf("the list indexes could not be created - %v", err)
+	}
+
+	// a collection can only have one text index so it covers every field;
+	// Cosmos DB doesn't support text indexes so, without one, searches scan
+	// the songs instead
+	weights := bson.D{}
+	keys := bson.D{}
+	for _, field := range []string{"title", "artist", "genre"} {
+		keys = append(keys, bson.E{Key: field, Value: "text"})
+		weights = append(weights, bson.E{Key: field, Value: searchWeights[field]})
+	}
+	_, err = s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetName("search").SetWeights(weights),
+	})
+	if err != nil {
+		platform.LoggerFor(ctx).Warnf("the search index could not be created so searches will scan the songs - %v", err)
+	}
+	s.textSearch = err == nil
+
+	// the index is sparse so that songs stored before it existed don't
+	// collide; they are given a key, and the lowercase fields, below. Cosmos
+	// DB only creates a unique index on an empty collection, so there the
+	// songs must be moved into a new collection to add it.
+	_, err = s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetName("unique_song").SetUnique(true).SetSparse(true),
+	})
+	if err != nil {
+		return fmt.Errorf("the unique song index could not be created - %v", err)
+	}
+	return s.backfill(ctx)
+}
+
+// backfill sets the key and the lowercase fields on songs stored before they
+// were added; existing duplicates are logged and left without a key.
+func (s *mongoStore) backfill(ctx context.Context) error {
+	missing := bson.M{"$or": bson.A{
+		bson.M{"key": bson.M{"$exists": false}},
+		bson.M{"artistLower": bson.M{"$exists": false}},
+	}}
+	cur, err := s.collection.Find(ctx, missing)
+	if err != nil {
+		return fmt.Errorf("the songs without a key could not be found - %v", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var val song
+		if err = cur.Decode(&val); err != nil {
+			return fmt.Errorf("a song without a key could not be decoded - %v", err)
+		}
+		oid, _ := primitive.ObjectIDFromHex(val.Id)
+		lower := bson.M{"artistLower": strings.ToLower(val.Artist), "genreLower": strings.ToLower(val.Genre)}
+		_, err = s.collection.UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": lower})
+		if err != nil {
+			return fmt.Errorf("the lowercase fields could not be set on song %v - %v", val.Id, err)
+		}
+		_, err = s.collection.UpdateOne(ctx, bson.M{"_id": oid, "key": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"key": songKey(val)}})
+		if mongo.IsDuplicateKeyError(err) {
+			platform.LoggerFor(ctx).Warnf("song %v is a duplicate of an existing song.", val.Id)
+		} else if err != nil {
+			return fmt.Errorf("the key could not be set on song %v - %v", val.Id, err)
+		}
+	}
+	return cur.Err()
+}
+
+// duplicateOf finds the song that has the same key as val.
+func (s *mongoStore) duplicateOf(ctx context.Context, val song) error {
+	var existing song
+	err := s.collection.FindOne(ctx, bson.M{"key": songKey(val)}).Decode(&existing)
+	if err != nil {
+		return fmt.Errorf("the song is a duplicate but the original could not be found - %v", err)
+	}
+	return &DuplicateError{ExistingId: existing.Id}
+}
+
+func (s *mongoStore) Get(ctx context.Context, id string) (song, error) {
+	var val song
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return val, ErrNotFound
+	}
+	err = s.collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&val)
+	if err == mongo.ErrNoDocuments {
+		return val, ErrNotFound
+	}
+	return val, err
+}
+
+func (s *mongoStore) Insert(ctx context.Context, val song) (song, error) {
+	id := primitive.NewObjectID()
+	_, err := s.collection.InsertOne(ctx, newSongDocument(id, val))
+	if mongo.IsDuplicateKeyError(err) {
+		return val, s.duplicateOf(ctx, val)
+	} else if err != nil {
+		return val, err
+	}
+	val.Id = id.Hex()
+	return val, nil
+}
+
+func (s *mongoStore) InsertMany(ctx context.Context, vals []song) ([]song, error) {
+	// assign the ids up front so they are known even if some inserts fail
+	stored := make([]song, len(vals))
+	docs := make([]interface{}, len(vals))
+	for i, val := range vals {
+		id := primitive.NewObjectID()
+		docs[i] = newSongDocument(id, val)
+		val.Id = id.Hex()
+		stored[i] = val
+	}
+
+	// an unordered insert carries on past documents that fail
+	_, err := s.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil && len(bulkErr.WriteErrors) > 0 {
+		rowErrs := RowErrors{}
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code == 11000 {
+				rowErrs[writeErr.Index] = s.duplicateOf(ctx, vals[writeErr.Index])
+			} else {
+				rowErrs[writeErr.Index] = errors.New(writeErr.Message)
+			}
+		}
+		return stored, rowErrs
+	}
+	return stored, err
+}
+
+func (s *mongoStore) List(ctx context.Context, opts listOptions) (page, error) {
+	result := page{Items: []song{}}
+
+	// read one more than the limit to find out if there is another page
+	findOpts := options.Find().
+		SetSort(mongoSort(opts)).
+		SetSkip(int64(opts.offset)).
+		SetLimit(int64(opts.limit + 1))
+	cur, err := s.collection.Find(ctx, mongoFilter(opts), findOpts)
+	if err != nil {
+		return result, err
+	}
+	err = cur.All(ctx, &result.Items)
+	if err != nil {
+		return result, err
+	}
+	if len(result.Items) > opts.limit {
+		result.Items = result.Items[:opts.limit]
+		last := result.Items[opts.limit-1]
+		result.NextCursor = encodeCursor(cursor{Value: opts.sortValue(last), Id: last.Id})
+	}
+	return result, nil
+}
+
+// Export walks a cursor over every matching song so the catalog is never
+// held in memory.
+func (s *mongoStore) Export(ctx context.Context, opts listOptions, fn func(val song) error) error {
+	findOpts := options.Find().
+		SetSort(mongoSort(opts)).
+		SetBatchSize(500)
+	cur, err := s.collection.Find(ctx, mongoFilter(opts), findOpts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var val song
+		err = cur.Decode(&val)
+		if err != nil {
+			return err
+		}
+		err = fn(val)
+		if err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (s *mongoStore) Update(ctx context.Context, id string, patch songPatch) (song, error) {
+	var val song
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return val, ErrNotFound
+	}
+
+	// the key depends on both the artist and title so the whole song is
+	// rewritten from the current one with the patch applied
+	err = s.collection.FindOne(ctx, bson.M{"_id": oid}).Decode(&val)
+	if err == mongo.ErrNoDocuments {
+		return val, ErrNotFound
+	} else if err != nil {
+		return val, err
+	}
+	patch.apply(&val)
+	result, err := s.collection.ReplaceOne(ctx, bson.M{"_id": oid}, newSongDocument(oid, val))
+	if mongo.IsDuplicateKeyError(err) {
+		return val, s.duplicateOf(ctx, val)
+	} else if err != nil {
+		return val, err
+	}
+	if result.MatchedCount == 0 {
+		return val, ErrNotFound
+	}
+	return val, nil
+}
+
+func (s *mongoStore) Delete(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	result, err := s.collection.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) Search(ctx context.Context, query string, limit int) ([]searchHit, error) {
+	if !s.textSearch {
+		return s.scanSearch(ctx, query, limit)
+	}
+	hits := []searchHit{}
+	score := bson.M{"$meta": "textScore"}
+	findOpts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}}).
+		SetLimit(int64(limit))
+	cur, err := s.collection.Find(ctx, bson.M{"$text": bson.M{"$search": query}}, findOpts)
+	if err != nil {
+		return hits, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var hit searchHit
+		err = cur.Decode(&hit.song)
+		if err != nil {
+			return hits, err
+		}
+		hit.Score, _ = cur.Current.Lookup("score").DoubleOK()
+		hits = append(hits, hit)
+	}
+	return hits, cur.Err()
+}
+
+// scanSearch ranks songs without a text index: every song that might contain
+// a query token is read and scored as the memory store scores it. It reads
+// more than a text search so it is only meant for small catalogs.
+func (s *mongoStore) scanSearch(ctx context.Context, query string, limit int) ([]searchHit, error) {
+	hits := []searchHit{}
+	matches := bson.A{}
+	for _, token := range tokenize(query) {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(token), Options: "i"}
+		for field := range searchWeights {
+			matches = append(matches, bson.M{field: pattern})
+		}
+	}
+	if len(matches) == 0 {
+		return hits, nil
+	}
+	total, err := s.collection.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return hits, err
+	}
+	cur, err := s.collection.Find(ctx, bson.M{"$or": matches})
+	if err != nil {
+		return hits, err
+	}
+	defer cur.Close(ctx)
+	index := newSearchIndex()
+	found := map[string]song{}
+	for cur.Next(ctx) {
+		var val song
+		err = cur.Decode(&val)
+		if err != nil {
+			return hits, err
+		}
+		index.add(val)
+		found[val.Id] = val
+	}
+	if err = cur.Err(); err != nil {
+		return hits, err
+	}
+
+	// every song with a query token was read so the scores are the same as
+	// if the whole catalog were indexed
+	for id, score := range index.search(query, int(total)) {
+		hits = append(hits, searchHit{song: found[id], Score: score})
+	}
+	rank(hits)
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// mongoFilter builds the query for the options; matching is case-insensitive
+// by comparing the lowercase fields so that their indexes can be used.
+func mongoFilter(opts listOptions) bson.M {
+	filter := bson.M{}
+	if opts.genre != "" {
+		filter["genreLower"] = strings.ToLower(opts.genre)
+	}
+	if opts.artist != "" {
+		filter["artistLower"] = strings.ToLower(opts.artist)
+	}
+
+	// resume after the cursor; ties on the sort field are broken by _id
+	if opts.after != nil {
+		op := "$gt"
+		if opts.descending {
+			op = "$lt"
+		}
+		id, _ := primitive.ObjectIDFromHex(opts.after.Id)
+		if opts.sortField == "id" {
+			filter["_id"] = bson.M{op: id}
+		} else {
+			filter["$or"] = bson.A{
+				bson.M{opts.sortField: bson.M{op: opts.after.Value}},
+				bson.M{opts.sortField: opts.after.Value, "_id": bson.M{op: id}},
+			}
+		}
+	}
+
+	return filter
+}
+
+// mongoSort orders by the requested field and then by _id so the order is
+// stable.
+func mongoSort(opts listOptions) bson.D {
+	dir := 1
+	if opts.descending {
+		dir = -1
+	}
+	if opts.sortField == "id" {
+		return bson.D{{Key: "_id", Value: dir}}
+	}
+	return bson.D{{Key: opts.sortField, Value: dir}, {Key: "_id", Value: dir}}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+// the relative importance of a match in each field; the Mongo text index and
+// the in-memory index use the same weights so they rank alike.
+var searchWeights = map[string]int{
+	"title":  3,
+	"artist": 2,
+	"genre":  1,
+}
+
+type searchHit struct {
+	song
+	Score float64 `json:"score"`
+}
+
+type searchResult struct {
+	Items []searchHit `json:"items"`
+}
+
+// tokenize splits text into lower-case words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchIndex is an inverted index from each token to the weighted number of
+// times it appears in each song.
+type searchIndex struct {
+	postings map[string]map[string]int
+	tokens   map[string][]string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{postings: map[string]map[string]int{}, tokens: map[string][]string{}}
+}
+
+func (idx *searchIndex) add(val song) {
+	fields := map[string]string{"title": val.Title, "artist": val.Artist, "genre": val.Genre}
+	for field, text := range fields {
+		for _, token := range tokenize(text) {
+			if idx.postings[token] == nil {
+				idx.postings[token] = map[string]int{}
+			}
+			if idx.postings[token][val.Id] == 0 {
+				idx.tokens[val.Id] = append(idx.tokens[val.Id], token)
+			}
+			idx.postings[token][val.Id] += searchWeights[field]
+		}
+	}
+}
+
+func (idx *searchIndex) remove(id string) {
+	for _, token := range idx.tokens[id] {
+		delete(idx.postings[token], id)
+		if len(idx.postings[token]) == 0 {
+			delete(idx.postings, token)
+		}
+	}
+	delete(idx.tokens, id)
+}
+
+// search scores every song containing a query token by the weighted term
+// frequency times the inverse document frequency of each token among the
+// total number of songs.
+func (idx *searchIndex) search(query string, total int) map[string]float64 {
+	scores := map[string]float64{}
+	for _, token := range tokenize(query) {
+		postings := idx.postings[token]
+		if len(postings) == 0 {
+			continue
+		}
+		idf := math.Log(1 + float64(total)/float64(len(postings)))
+		for id, weight := range postings {
+			scores[id] += float64(weight) * idf
+		}
+	}
+	return scores
+}
+
+// rank orders hits by descending score, breaking ties by id.
+func rank(hits []searchHit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score == hits[j].Score {
+			return hits[i].Id < hits[j].Id
+		}
+		return hits[i].Score > hits[j].Score
+	})
+}
+
+func search(w http.ResponseWriter, r *http.Request, songStore SongStore) {
+	// get the query and limit
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		platform.HttpError(w, "a search query was not provided.", http.StatusBadRequest)
+		return
+	}
+	limit := defaultListLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			platform.HttpError(w, "limit must be a number between 1 and 100.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// search the store
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	hits, err := songStore.Search(ctx, query, limit)
+	if err != nil {
+		platform.HttpError(w, "the songs could not be searched.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the songs could not be searched - %v", err)
+		return
+	}
+
+	// write JSON output
+	platform.LoggerFor(r.Context()).Infof("found %v songs matching \"%v\".", len(hits), query)
+	bytes, err := json.Marshal(searchResult{Items: hits})
+	if err != nil {
+		platform.HttpError(w, "the songs could not be marshalled.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the songs could not be marshalled - %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(bytes)
+	if err != nil {
+		platform.HttpError(w, "the songs could not be written.", http.StatusInternalServerError)
+		platform.LoggerFor(r.Context()).Errorf("the songs could not be written - %v", err)
+		return
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotFound is returned by a SongStore when no song has the requested id.
+var ErrNotFound = errors.New("no song with that id was found")
+
+// DuplicateError is returned by a SongStore when another song already has
+// the same artist and title.
+type DuplicateError struct {
+	ExistingId string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("the song is a duplicate of %v", e.ExistingId)
+}
+
+// songKey identifies a song by its artist and title, ignoring case and
+// differences in whitespace, so duplicates can be detected.
+func songKey(val song) string {
+	normalize := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+	return normalize(val.Artist) + "\x1f" + normalize(val.Title)
+}
+
+// RowErrors is returned by InsertMany when only some of the songs could be
+// stored; it maps the index of each song that failed to the reason.
+type RowErrors map[int]error
+
+func (e RowErrors) Error() string {
+	return fmt.Sprintf("%v songs could not be stored", len(e))
+}
+
+// SongStore is the storage backend for songs. Ids are the hex form of a
+// Mongo ObjectID regardless of the backend.
+type SongStore interface {
+	Get(ctx context.Context, id string) (song, error)
+	Insert(ctx context.Context, val song) (song, error)
+	InsertMany(ctx context.Context, vals []song) ([]song, error)
+	List(ctx context.Context, opts listOptions) (page, error)
+	Export(ctx context.Context, opts listOptions, fn func(val song) error) error
+	Update(ctx context.Context, id string, patch songPatch) (song, error)
+	Delete(ctx context.Context, id string) error
+	Search(ctx context.Context, query string, limit int) ([]searchHit, error)
+}
+
+type songPatch struct {
+	Artist *string `json:"artist"`
+	Title  *string `json:"title"`
+	Genre  *string `json:"genre"`
+}
+
+// replacing a song is the same as patching every field.
+func replacement(val song) songPatch {
+	return songPatch{Artist: &val.Artist, Title: &val.Title, Genre: &val.Genre}
+}
+
+func (p songPatch) isEmpty() bool {
+	return p.Artist == nil && p.Title == nil && p.Genre == nil
+}
+
+// apply copies every field that was present in the patch onto the song.
+func (p songPatch) apply(val *song) {
+	if p.Artist != nil {
+		val.Artist = *p.Artist
+	}
+	if p.Title != nil {
+		val.Title = *p.Title
+	}
+	if p.Genre != nil {
+		val.Genre = *p.Genre
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/plasne/aks-lab/sample/platform"
+)
+
+const maxArtistLength = 200
+const maxTitleLength = 200
+const maxGenreLength = 50
+
+// allowedGenres is read from ALLOWED_GENRES; when it is empty any genre is
+// accepted.
+var allowedGenres []string
+
+func loadAllowedGenres() {
+	allowedGenres = nil
+	for _, genre := range strings.Split(os.Getenv("ALLOWED_GENRES"), ",") {
+		if genre = strings.TrimSpace(genre); genre != "" {
+			allowedGenres = append(allowedGenres, genre)
+		}
+	}
+}
+
+type fieldError struct {
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+// problem is an RFC 7807 problem details response.
+type problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+
+	// RequestId identifies the request in the logs of every service.
+	RequestId string `json:"requestId,omitempty"`
+
+	// ExistingId is set when the song conflicts with one already stored.
+	ExistingId string `json:"existingId,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, p *problem) {
+	p.RequestId = w.Header().Get(platform.RequestIdHeader)
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		platform.HttpError(w, p.Title, p.Status)
+		platform.ServiceLog.Errorf("the problem could not be marshalled - %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(bytes)
+}
+
+func invalidSong(errs []fieldError) *problem {
+	return &problem{
+		Type:   "/problems/invalid-song",
+		Title:  "the song is not valid.",
+		Status: http.StatusBadRequest,
+		Errors: errs,
+	}
+}
+
+// writeDuplicate responds with a 409 pointing at the song that already has
+// the same artist and title.
+func writeDuplicate(w http.ResponseWriter, dupErr *DuplicateError) {
+	w.Header().Set("Location", "/?id="+dupErr.ExistingId)
+	writeProblem(w, &problem{
+		Type:       "/problems/duplicate-song",
+		Title:      "a song with the same artist and title already exists.",
+		Status:     http.StatusConflict,
+		ExistingId: dupErr.ExistingId,
+	})
+}
+
+// decodeStrict decodes a JSON body into v, rejecting unknown fields, and
+// describes anything wrong with the body as a problem.
+func decodeStrict(body io.Reader, v interface{}) *problem {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+	malformed := &problem{
+		Type:   "/problems/malformed-body",
+		Title:  "the body could not be decoded.",
+		Status: http.StatusBadRequest,
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		malformed.Errors = []fieldError{{typeErr.Field, fmt.Sprintf("must be a %v.", typeErr.Type)}}
+	} else if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+		malformed.Errors = []fieldError{{field, "is not a known field."}}
+	} else {
+		malformed.Detail = err.Error()
+	}
+	return malformed
+}
+
+// validateField checks a single field against its length limit and, for the
+// genre, the allowed list; it returns the field as it should be stored.
+func validateField(field, value string, required bool, errs *[]fieldError) string {
+	value = strings.TrimSpace(value)
+	limits := map[string]int{"artist": maxArtistLength, "title": maxTitleLength, "genre": maxGenreLength}
+	if value == "" {
+		if required {
+			*errs = append(*errs, fieldError{field, "is required."})
+		}
+		return value
+	}
+	if utf8.RuneCountInString(value) > limits[field] {
+		*errs = append(*errs, fieldError{field, fmt.Sprintf("must be at most %v characters.", limits[field])})
+		return value
+	}
+	if field == "genre" && len(allowedGenres) > 0 {
+		for _, genre := range allowedGenres {
+			if strings.EqualFold(genre, value) {
+				return genre
+			}
+		}
+		*errs = append(*errs, fieldError{field, fmt.Sprintf("must be one of %v.", strings.Join(allowedGenres, ", "))})
+	}
+	return value
+}
+
+// validateSong checks a whole song and normalises its fields in place.
+func validateSong(val *song) []fieldError {
+	errs := []fieldError{}
+	val.Artist = validateField("artist", val.Artist, true, &errs)
+	val.Title = validateField("title", val.Title, true, &errs)
+	val.Genre = validateField("genre", val.Genre, false, &errs)
+	return errs
+}
+
+// validatePatch checks only the fields present in the patch; a field that
+// is present may not be blanked out if it is required.
+func validatePatch(patch *songPatch) []fieldError {
+	errs := []fieldError{}
+	if patch.Artist != nil {
+		*patch.Artist = validateField("artist", *patch.Artist, true, &errs)
+	}
+	if patch.Title != nil {
+		*patch.Title = validateField("title", *patch.Title, true, &errs)
+	}
+	if patch.Genre != nil {
+		*patch.Genre = validateField("genre", *patch.Genre, false, &errs)
+	}
+	return errs
+}
+
+// describe joins field errors into one message for places that can only
+// report a string, such as a row of an import.
+func describe(errs []fieldError) string {
+	parts := make([]string, len(errs))
+	for i, e := range errs {
+		parts[i] = fmt.Sprint(e.Field, " ", e.Detail)
+	}
+	return strings.Join(parts, " ")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,8 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -23,6 +26,10 @@ type song struct {
 	Artist  string  `json:"artist"`
 	Payment float64 `json:"payment"`
 	Genre   string  `json:"genre"`
+
+	// PaymentUnavailable is set when the artist's contract could not be
+	// looked up, so the payment of 0 is not mistaken for a real one
+	PaymentUnavailable bool `json:"paymentUnavailable,omitempty"`
 }
 
 type contract struct {
@@ -33,6 +40,11 @@ type contract struct {
 var songServiceBaseUrl = "http://songs"
 var contractServiceBaseUrl = "http://contracts"
 
+// contract lookups for one request run at most this many at a time and must
+// all finish within the timeout
+var contractLookupConcurrency = 10
+var contractLookupTimeout = 5 * time.Second
+
 func main() {
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -57,6 +69,18 @@ func main() {
 	}
 	log.Println("contractServiceBaseUrl:", contractServiceBaseUrl)
 
+	concurrency, err := strconv.Atoi(os.Getenv("CONTRACT_LOOKUP_CONCURRENCY"))
+	if err == nil && concurrency > 0 {
+		contractLookupConcurrency = concurrency
+	}
+	log.Println("contractLookupConcurrency:", contractLookupConcurrency)
+
+	timeoutMs, err := strconv.Atoi(os.Getenv("CONTRACT_LOOKUP_TIMEOUT_MS"))
+	if err == nil && timeoutMs > 0 {
+		contractLookupTimeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	log.Println("contractLookupTimeout:", contractLookupTimeout)
+
 	router := gin.Default()
 	router.GET("/health", getHealth)
 	router.GET("/songs", getSong)
@@ -138,43 +162,102 @@ func getSong(c *gin.Context) {
 		songs = append(songs, singlesong)
 	}
 
-	// Get payment info for each song
+	// Get payment info for each artist once and flag the songs whose lookup failed
+	artists := make([]string, len(songs))
 	for index := range songs {
-		songs[index].Payment = getArtistPayment(songs[index].Artist)
+		artists[index] = songs[index].Artist
+	}
+	payments := getArtistPayments(c.Request.Context(), artists)
+	for index := range songs {
+		payment, ok := payments[songs[index].Artist]
+		songs[index].Payment = payment
+		songs[index].PaymentUnavailable = !ok
 	}
 
 	c.IndentedJSON(http.StatusOK, songs)
 }
 
+// Looks up the payment for each distinct artist once, running at most
+// contractLookupConcurrency lookups at a time within contractLookupTimeout.
+// Artists whose lookup failed are left out of the result
+func getArtistPayments(ctx context.Context, artists []string) map[string]float64 {
+	ctx, cancel := context.WithTimeout(ctx, contractLookupTimeout)
+	defer cancel()
+
+	// Queue each artist only once
+	seen := map[string]bool{}
+	jobs := make(chan string, len(artists))
+	for _, artist := range artists {
+		if !seen[artist] {
+			seen[artist] = true
+			jobs <- artist
+		}
+	}
+	close(jobs)
+
+	// Start the workers, no more than there are artists
+	workers := contractLookupConcurrency
+	if len(seen) < workers {
+		workers = len(seen)
+	}
+	payments := make(map[string]float64, len(seen))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for artist := range jobs {
+				payment, err := getArtistPayment(ctx, artist)
+				if err != nil {
+					log.Println("ERROR: getting contract for artist: ", artist)
+					log.Println("ERROR: message ", err)
+					continue
+				}
+				mutex.Lock()
+				payments[artist] = payment
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return payments
+}
+
 // Queries to get the contract for the given artist and return the payment value
-// If no contrat exists it returns a default payment of 0
-func getArtistPayment(artist string) float64 {
+// If no contract exists it returns a default payment of 0
+func getArtistPayment(ctx context.Context, artist string) (float64, error) {
 	contractServiceURL := fmt.Sprint(contractServiceBaseUrl, "?artist=", url.QueryEscape(artist))
 
 	// Query to get the contract
-	contractResponse, err := http.Get(contractServiceURL)
+	contractRequest, err := http.NewRequestWithContext(ctx, "GET", contractServiceURL, nil)
 	if err != nil {
-		log.Println("ERROR: getting contract for artist: ", artist)
-		log.Println("ERROR: message ", err)
-		return 0
+		return 0, err
 	}
+	contractResponse, err := http.DefaultClient.Do(contractRequest)
+	if err != nil {
+		return 0, err
+	}
+	defer contractResponse.Body.Close()
 
 	// Make sure contract query was successful
-	if contractResponse.StatusCode > 299 {
+	if contractResponse.StatusCode == http.StatusNotFound {
 		log.Println("WARNING: No contract found for artist: ", artist)
-		return 0
+		return 0, nil
+	}
+	if contractResponse.StatusCode > 299 {
+		return 0, fmt.Errorf("contract service returned %v", contractResponse.StatusCode)
 	}
 
 	// Json decode contract values
 	var contract contract
 	err = json.NewDecoder(contractResponse.Body).Decode(&contract)
 	if err != nil {
-		log.Println("ERROR: decoding contract for artist: ", artist)
-		log.Println("ERROR: message ", err)
-		return 0
+		return 0, err
 	}
 
-	return contract.Payment
+	return contract.Payment, nil
 }
 
 // postSong adds a song from JSON received in the request body.
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// fakeContracts stands in for the contracts service. Each lookup takes a
+// moment so that lookups overlap, and it records how many were in flight at
+// once and which artists were asked for.
+type fakeContracts struct {
+	mutex    sync.Mutex
+	inFlight int
+	most     int
+	asked    map[string]int
+}
+
+func (f *fakeContracts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	artist := r.URL.Query().Get("artist")
+	f.mutex.Lock()
+	f.asked[artist]++
+	f.inFlight++
+	if f.inFlight > f.most {
+		f.most = f.inFlight
+	}
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		f.inFlight--
+		f.mutex.Unlock()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	switch artist {
+	case "Broken":
+		http.Error(w, "the contract could not be read.", http.StatusInternalServerError)
+	case "Nobody":
+		http.NotFound(w, r)
+	default:
+		json.NewEncoder(w).Encode(contract{Artist: artist, Payment: float64(len(artist)) / 100})
+	}
+}
+
+// contractsServer starts a fake contracts service and points the lookups at
+// it, at most concurrency at a time.
+func contractsServer(t *testing.T, concurrency int) *fakeContracts {
+	fake := &fakeContracts{asked: map[string]int{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	contractServiceBaseUrl = server.URL
+	contractLookupConcurrency = concurrency
+	contractLookupTimeout = 5 * time.Second
+	return fake
+}
+
+func TestGetArtistPayments(t *testing.T) {
+	fake := contractsServer(t, 2)
+	artists := []string{"Drake", "Tyga", "Drake", "Weezer", "Broken", "Nobody", "Tyga", "Lizzo"}
+	payments := getArtistPayments(context.Background(), artists)
+
+	// each artist is looked up once, no more than two at a time
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for artist, calls := range fake.asked {
+		if calls != 1 {
+			t.Fatalf("expected %v to be looked up once, got %v", artist, calls)
+		}
+	}
+	if len(fake.asked) != 6 {
+		t.Fatalf("expected 6 artists to be looked up, got %v", fake.asked)
+	}
+	if fake.most != 2 {
+		t.Fatalf("expected at most 2 lookups at a time, got %v", fake.most)
+	}
+
+	// a failed lookup is left out while a missing contract pays nothing
+	expected := map[string]float64{"Drake": 0.05, "Tyga": 0.04, "Weezer": 0.06, "Nobody": 0, "Lizzo": 0.05}
+	if len(payments) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, payments)
+	}
+	for artist, payment := range expected {
+		if got, ok := payments[artist]; !ok || got != payment {
+			t.Fatalf("expected %v for %v, got %v", payment, artist, payments)
+		}
+	}
+}
+
+func TestGetSongPayments(t *testing.T) {
+	contractsServer(t, 3)
+	songsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]song{
+			{Id: "1", Artist: "Weezer", Title: "Africa"},
+			{Id: "2", Artist: "Broken", Title: "Nothing"},
+			{Id: "3", Artist: "Drake", Title: "Nonstop"},
+			{Id: "4", Artist: "Weezer", Title: "Buddy Holly"},
+		})
+	}))
+	defer songsServer.Close()
+	songServiceBaseUrl = songsServer.URL
+
+	// the songs keep their order and each is paid from its artist's contract
+	router := gin.New()
+	router.GET("/songs", getSong)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/songs", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	var songs []song
+	json.Unmarshal(w.Body.Bytes(), &songs)
+	expected := []song{
+		{Id: "1", Artist: "Weezer", Title: "Africa", Payment: 0.06},
+		{Id: "2", Artist: "Broken", Title: "Nothing", PaymentUnavailable: true},
+		{Id: "3", Artist: "Drake", Title: "Nonstop", Payment: 0.05},
+		{Id: "4", Artist: "Weezer", Title: "Buddy Holly", Payment: 0.06},
+	}
+	if len(songs) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, songs)
+	}
+	for i := range expected {
+		if songs[i] != expected[i] {
+			t.Fatalf("expected song %v to be %+v, got %+v", i, expected[i], songs[i])
+		}
+	}
+}